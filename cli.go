@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	commandInit       = "init"
+	defaultConfigPath = "update-apt-source.yaml"
+)
+
+const usage = `Usage: update-apt-source <command> [flags]
+
+Manages a Debian/Ubuntu APT repository in cloud storage. Run without
+arguments, as the GitHub Action does, the command and every setting are
+read from INPUT_<NAME> environment variables.
+
+Commands:
+  publish    publish .deb packages (default)
+  migrate    move packages of the dists layout into the pool
+  promote    copy a published package to another distro or component
+  remove     remove packages from the indexes
+  list       print the published packages
+  verify     check signatures, indexes and package files
+  rebuild    regenerate the indexes from the stored packages
+  gc         delete package files no index references
+  snapshot   freeze the published indexes under a name
+  rollback   restore the indexes of a snapshot
+  init       write a config file template to --config
+
+Every flag can also be set as INPUT_<NAME> in the environment, e.g.
+INPUT_BUCKET_NAME for --bucket-name, or in the YAML config file given by
+--config, with the flag name in snake case as key. Flags take precedence
+over the environment, which takes precedence over the config file.
+
+Flags:
+`
+
+// input is a setting of the tool, named like the action input it is read
+// from when running as a GitHub Action.
+type input struct {
+	name    string
+	usage   string
+	boolean bool
+	secret  bool
+}
+
+var inputs = []input{
+	{name: "config", usage: "YAML config file with default settings"},
+	{name: "ubuntu_distro", usage: "distribution codename (e.g., focal, jammy, bookworm, or all)"},
+	{name: "component", usage: "repository component to publish to (defaults to main, or stable with all)"},
+	{name: "package_name", usage: "package to promote or remove"},
+	{name: "package_version", usage: "version to promote or remove, any version when empty"},
+	{name: "source_distro", usage: "distribution codename to promote from"},
+	{name: "source_component", usage: "component to promote from (defaults to main)"},
+	{name: "filter", usage: "filter expression selecting the packages to remove or list"},
+	{name: "delete_debs", usage: "also delete package files that no remaining index references on remove", boolean: true},
+	{name: "format", usage: "output format of list: table or json (default table)"},
+	{name: "min_age", usage: "minimum age of unreferenced files that gc deletes (default the repository retention, or 24h)"},
+	{name: "dry_run", usage: "print the planned changes without changing the bucket", boolean: true},
+	{name: "snapshot_name", usage: "name of the snapshot to create or restore"},
+	{name: "deb_paths", usage: "paths to .deb packages, separated by commas"},
+	{name: "architectures", usage: "architecture of each .deb package, in the same order as deb-paths (default the Architecture field of each package)"},
+	{name: "storage_type", usage: "cloud storage type, aws or oss"},
+	{name: "endpoint", usage: "cloud storage endpoint"},
+	{name: "region", usage: "cloud storage region"},
+	{name: "bucket_name", usage: "cloud storage bucket name"},
+	{name: "base_url", usage: "public URL of the repository root, for the action outputs (default the bucket URL at the endpoint)"},
+	{name: "access_key_id", usage: "cloud storage access key ID", secret: true},
+	{name: "access_key_secret", usage: "cloud storage access key secret", secret: true},
+	{name: "gpg_private_key", usage: "GPG private key for signing (base64 encoded)", secret: true},
+	{name: "gpg_private_key_file", usage: "file holding the armored GPG private key, instead of gpg-private-key"},
+	{name: "gpg_public_key", usage: "GPG public key that verify checks signatures against (base64 encoded)"},
+	{name: "gpg_public_key_file", usage: "file holding the armored GPG public key, instead of gpg-public-key"},
+	{name: "full_release", usage: "rebuild the Release file from every index file in the bucket", boolean: true},
+	{name: "concurrency", usage: "maximum number of packages, redirects and distributions processed in parallel (default 4)"},
+	{name: "retry_attempts", usage: "maximum attempts for each storage call that fails transiently (default 5)"},
+	{name: "retry_backoff", usage: "initial backoff between retries (default 1s)"},
+	{name: "log_format", usage: "log format: text or json (default text)"},
+	{name: "log_level", usage: "minimum level logged: debug, info, warn or error (default info)"},
+	{name: "distributions", usage: "distribution codenames that may be published to, separated by commas"},
+	{name: "all_distributions", usage: "distribution codenames that all expands to"},
+	{name: "suites", usage: "symbolic suites mapped to codenames, e.g. stable=jammy,testing=noble"},
+	{name: "layout", usage: "where packages are stored: dists or pool (default dists)"},
+	{name: "repo_config", usage: "repository config file (default apt-repo.yaml if present, else apt-repo.yaml in the bucket)"},
+	{name: "symlink_strategy", usage: "how packages are linked: copy, redirect, metadata, symlink or dedup"},
+}
+
+// settings resolves the value of each input from the command line, the
+// environment and the config file, in that order.
+type settings struct {
+	flags map[string]string
+	file  map[string]string
+}
+
+func (s *settings) get(name string) string {
+	if value, ok := s.flags[name]; ok {
+		return value
+	}
+	// The runner sets every declared input, empty when it was not given.
+	if value := os.Getenv("INPUT_" + strings.ToUpper(name)); value != "" {
+		return value
+	}
+	return s.file[name]
+}
+
+// parseArgs parses the command line, which is empty when running as a
+// GitHub Action, and loads the config file it or the environment names.
+// It returns flag.ErrHelp once help has been printed.
+func parseArgs(args []string, output io.Writer) (*settings, error) {
+	s := &settings{flags: make(map[string]string)}
+
+	fs := flag.NewFlagSet("update-apt-source", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	for _, in := range inputs {
+		name := strings.ReplaceAll(in.name, "_", "-")
+		if in.boolean {
+			fs.Bool(name, false, in.usage)
+		} else {
+			fs.String(name, "", in.usage)
+		}
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] == "help" {
+			fs.Usage()
+			return nil, flag.ErrHelp
+		}
+		s.flags["command"] = args[0]
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q, flags must come after the command", fs.Arg(0))
+	}
+	fs.Visit(func(f *flag.Flag) {
+		s.flags[strings.ReplaceAll(f.Name, "-", "_")] = f.Value.String()
+	})
+
+	path := s.get("config")
+	if path == "" || s.get("command") == commandInit {
+		return s, nil
+	}
+	file, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// loadConfigFile reads a YAML config file into input values. Lists are
+// joined by newlines and maps become suite=codename style lines, as the
+// multiline action inputs are written.
+func loadConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file failed: %v", err)
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("parse config file %s failed: %v", path, err)
+	}
+
+	file := make(map[string]string, len(raw))
+	for key, value := range raw {
+		known := key == "command" || slices.ContainsFunc(inputs, func(in input) bool { return in.name == key })
+		if !known || key == "config" {
+			return nil, fmt.Errorf("unknown setting %q in config file %s", key, path)
+		}
+		switch v := value.(type) {
+		case nil:
+		case []any:
+			lines := make([]string, len(v))
+			for i, item := range v {
+				lines[i] = fmt.Sprint(item)
+			}
+			file[key] = strings.Join(lines, "\n")
+		case map[string]any:
+			var lines []string
+			for k, item := range v {
+				lines = append(lines, fmt.Sprintf("%s=%v", k, item))
+			}
+			slices.Sort(lines)
+			file[key] = strings.Join(lines, "\n")
+		default:
+			file[key] = fmt.Sprint(v)
+		}
+	}
+	return file, nil
+}
+
+// initConfig writes a config file template listing every setting, and
+// never overwrites an existing file.
+func initConfig(path string) error {
+	if path == "" {
+		path = defaultConfigPath
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create config file failed: %v", err)
+	}
+	defer f.Close()
+
+	var content strings.Builder
+	content.WriteString("# Settings of update-apt-source, see update-apt-source --help.\n")
+	content.WriteString("# Flags and INPUT_* environment variables take precedence.\n")
+	content.WriteString("# Prefer the environment for secrets.\n\n")
+	content.WriteString("# command to run when none is given on the command line\n# command: publish\n")
+	for _, in := range inputs {
+		if in.name == "config" {
+			continue
+		}
+		fmt.Fprintf(&content, "\n# %s\n# %s:\n", in.usage, in.name)
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		return fmt.Errorf("write config file failed: %v", err)
+	}
+	slog.Info("wrote config file", "path", path)
+	return nil
+}
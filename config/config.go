@@ -2,11 +2,68 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
 	"slices"
+	"strings"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/deb"
+)
+
+const (
+	CommandPublish  = "publish"
+	CommandMigrate  = "migrate"
+	CommandPromote  = "promote"
+	CommandRemove   = "remove"
+	CommandList     = "list"
+	CommandVerify   = "verify"
+	CommandRebuild  = "rebuild"
+	CommandGC       = "gc"
+	CommandSnapshot = "snapshot"
+	CommandRollback = "rollback"
+)
+
+var validCommands = []string{
+	CommandPublish,
+	CommandMigrate,
+	CommandPromote,
+	CommandRemove,
+	CommandList,
+	CommandVerify,
+	CommandRebuild,
+	CommandGC,
+	CommandSnapshot,
+	CommandRollback,
+}
+
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+var validFormats = []string{
+	FormatTable,
+	FormatJSON,
+}
+
+const (
+	// LayoutDists stores packages next to the index of each distro.
+	LayoutDists = "dists"
+	// LayoutPool stores packages once under pool/, shared by all distros.
+	LayoutPool = "pool"
 )
 
-var validUbuntuDistro = []string{
-	"all",
+var validLayouts = []string{
+	LayoutDists,
+	LayoutPool,
+}
+
+// AllDistros is the pseudo distro that publishes to every distro in
+// RepoConfig.AllDistributions.
+const AllDistros = "all"
+
+var defaultDistributions = []string{
 	"bionic",
 	"focal",
 	"jammy",
@@ -14,6 +71,161 @@ var validUbuntuDistro = []string{
 	"trusty",
 }
 
+var defaultAllDistributions = []string{
+	"bionic",
+	"focal",
+	"jammy",
+	"noble",
+}
+
+var validCodename = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*$`)
+
+const (
+	CompressionGzip = "gz"
+	CompressionXz   = "xz"
+)
+
+var validCompressions = []string{
+	CompressionGzip,
+	CompressionXz,
+}
+
+var validArchitecture = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// RepoConfig holds the repository-wide settings that every publisher of a
+// repository must agree on.
+type RepoConfig struct {
+	// Origin, Label and Description are written to every Release file.
+	Origin      string `yaml:"origin"`
+	Label       string `yaml:"label"`
+	Description string `yaml:"description"`
+	// Distributions lists the codenames that may be published to.
+	Distributions []string `yaml:"distributions"`
+	// AllDistributions lists the codenames that the "all" distro expands to.
+	AllDistributions []string `yaml:"all_distributions"`
+	// Suites maps symbolic suites such as stable or testing to the codename
+	// they currently point at.
+	Suites map[string]string `yaml:"suites"`
+	// Components and Architectures restrict what may be published, any
+	// component and architecture when empty.
+	Components    []string `yaml:"components"`
+	Architectures []string `yaml:"architectures"`
+	// Compressions lists the compressed variants written next to every
+	// Packages index.
+	Compressions []string      `yaml:"compressions"`
+	Signing      SigningConfig `yaml:"signing"`
+}
+
+// SigningConfig pins the key that signs the repository.
+type SigningConfig struct {
+	// PublicKey is the armored public key that verify checks against.
+	PublicKey string `yaml:"public_key"`
+	// Fingerprint is the fingerprint of the only key allowed to sign.
+	Fingerprint string `yaml:"fingerprint"`
+}
+
+func DefaultRepoConfig() RepoConfig {
+	return RepoConfig{
+		Origin:           "coScene APT source",
+		Label:            "coScene",
+		Description:      "CoScene APT Repository",
+		Distributions:    slices.Clone(defaultDistributions),
+		AllDistributions: slices.Clone(defaultAllDistributions),
+		Compressions:     []string{CompressionGzip},
+	}
+}
+
+func (r *RepoConfig) IsValid() error {
+	if len(r.Distributions) == 0 {
+		return fmt.Errorf("distributions is required")
+	}
+	for _, d := range r.Distributions {
+		if d == AllDistros {
+			return fmt.Errorf("distributions must not contain the reserved name %q", AllDistros)
+		}
+		if !validCodename.MatchString(d) {
+			return fmt.Errorf("distribution codename is not valid: %q", d)
+		}
+	}
+	for _, d := range r.AllDistributions {
+		if !slices.Contains(r.Distributions, d) {
+			return fmt.Errorf("all distributions contains %q, which is not in distributions %v", d, r.Distributions)
+		}
+	}
+	codenames := make(map[string]string)
+	for suite, codename := range r.Suites {
+		if suite == AllDistros || slices.Contains(r.Distributions, suite) {
+			return fmt.Errorf("suite %q must not also be a distribution", suite)
+		}
+		if !validCodename.MatchString(suite) {
+			return fmt.Errorf("suite name is not valid: %q", suite)
+		}
+		if !slices.Contains(r.Distributions, codename) {
+			return fmt.Errorf("suite %q points at %q, which is not in distributions %v", suite, codename, r.Distributions)
+		}
+		// A Release file carries a single Suite field.
+		if other, ok := codenames[codename]; ok {
+			return fmt.Errorf("suites %q and %q both point at %q", other, suite, codename)
+		}
+		codenames[codename] = suite
+	}
+	for _, component := range r.Components {
+		if !validCodename.MatchString(component) {
+			return fmt.Errorf("component is not valid: %q", component)
+		}
+	}
+	for _, arch := range r.Architectures {
+		if !validArchitecture.MatchString(arch) {
+			return fmt.Errorf("architecture is not valid: %q", arch)
+		}
+	}
+	for _, compression := range r.Compressions {
+		if !slices.Contains(validCompressions, compression) {
+			return fmt.Errorf("compression is not valid: %q, expected one of %v", compression, validCompressions)
+		}
+	}
+	if r.Signing.Fingerprint != "" && len(NormalizeFingerprint(r.Signing.Fingerprint)) != 40 {
+		return fmt.Errorf("signing fingerprint is not a 40 digit hex fingerprint: %q", r.Signing.Fingerprint)
+	}
+	return nil
+}
+
+// NormalizeFingerprint returns a key fingerprint in upper case without the
+// spaces gpg prints it with.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
+
+// HasComponent reports whether packages may be published to component.
+func (r *RepoConfig) HasComponent(component string) bool {
+	return len(r.Components) == 0 || slices.Contains(r.Components, component)
+}
+
+// HasArchitecture reports whether packages of arch may be published.
+// Architecture independent packages are always allowed.
+func (r *RepoConfig) HasArchitecture(arch string) bool {
+	return len(r.Architectures) == 0 || arch == "all" || slices.Contains(r.Architectures, arch)
+}
+
+// SuiteFor returns the suite that points at codename, or "" if there is none.
+func (r *RepoConfig) SuiteFor(codename string) string {
+	for suite, c := range r.Suites {
+		if c == codename {
+			return suite
+		}
+	}
+	return ""
+}
+
+// HasDistro reports whether distro may be published to, either as one of
+// the configured distributions or as the "all" distro.
+func (r *RepoConfig) HasDistro(distro string) bool {
+	if distro == AllDistros {
+		return len(r.AllDistributions) > 0
+	}
+	return slices.Contains(r.Distributions, distro)
+}
+
 var validStorageTypes = []string{
 	"s3",
 	"aws",
@@ -21,62 +233,211 @@ var validStorageTypes = []string{
 	"aliyun",
 }
 
+var validSymlinkStrategies = map[string][]string{
+	"s3":     {"", "copy", "redirect", "metadata", "dedup"},
+	"aws":    {"", "copy", "redirect", "metadata", "dedup"},
+	"oss":    {"", "symlink", "dedup"},
+	"aliyun": {"", "symlink", "dedup"},
+}
+
+const (
+	defaultComponent    = "main"
+	defaultAllComponent = "stable"
+)
+
 type Config struct {
+	Repo            RepoConfig
+	Command         string
 	UbuntuDistro    string
+	Component       string
+	PackageName     string
+	PackageVersion  string
+	SourceDistro    string
+	SourceComponent string
+	Filter          string
+	DeleteDebs      bool
+	Format          string
+	MinAge          time.Duration
+	DryRun          bool
+	SnapshotName    string
 	DebPaths        []string
 	Architectures   []string
 	StorageType     string
 	Endpoint        string
 	Region          string
 	BucketName      string
+	BaseURL         string
 	AccessKeyId     string
 	AccessKeySecret string
 	GpgPrivateKey   []byte
+	GpgPublicKey    []byte
+	FullRelease     bool
+	Concurrency     int
+	RetryAttempts   int
+	RetryBackoff    time.Duration
+	SymlinkStrategy string
+	Layout          string
 }
 
 func (c *Config) IsValid() error {
-	if !slices.Contains(validUbuntuDistro, c.UbuntuDistro) {
-		return fmt.Errorf("ubuntu distribution is not valid: %s", c.UbuntuDistro)
+	if err := c.CheckSettings(); err != nil {
+		return err
+	}
+	if err := c.Repo.IsValid(); err != nil {
+		return fmt.Errorf("repository config is not valid: %v", err)
+	}
+	// gc scans the whole bucket, so it takes no distro.
+	if c.Command != CommandGC && !c.Repo.HasDistro(c.UbuntuDistro) {
+		return fmt.Errorf("ubuntu distribution is not valid: %s, expected one of %v or %s", c.UbuntuDistro, c.Repo.Distributions, AllDistros)
+	}
+	if c.Component != "" && !validCodename.MatchString(c.Component) {
+		return fmt.Errorf("component is not valid: %q", c.Component)
+	}
+	// Other commands treat an empty component as every component.
+	component := c.Component
+	if c.Command == CommandPublish || c.Command == CommandPromote {
+		component = c.ComponentFor(c.UbuntuDistro)
+	}
+	if component != "" && !c.Repo.HasComponent(component) {
+		return fmt.Errorf("component %s is not one of the repository components %v", component, c.Repo.Components)
+	}
+	for _, arch := range c.Architectures {
+		if !c.Repo.HasArchitecture(arch) {
+			return fmt.Errorf("architecture %s is not one of the repository architectures %v", arch, c.Repo.Architectures)
+		}
 	}
-	if c.DebPaths == nil {
-		return fmt.Errorf("deb paths is required: %s", c.DebPaths)
+	if c.Command == CommandPublish {
+		if c.DebPaths == nil {
+			return fmt.Errorf("deb paths is required: %s", c.DebPaths)
+		}
+		if len(c.DebPaths) <= 0 {
+			return fmt.Errorf("deb paths is required: %s", c.DebPaths)
+		}
+		if len(c.DebPaths) != len(c.Architectures) {
+			return fmt.Errorf("deb paths and architectures must have the same number of elements: %d != %d", len(c.DebPaths), len(c.Architectures))
+		}
 	}
-	if len(c.DebPaths) <= 0 {
-		return fmt.Errorf("deb paths is required: %s", c.DebPaths)
+	if c.Command == CommandPromote {
+		if c.PackageName == "" {
+			return fmt.Errorf("package name is required: %s", c.PackageName)
+		}
+		if c.SourceDistro == AllDistros || !c.Repo.HasDistro(c.SourceDistro) {
+			return fmt.Errorf("source distribution is not valid: %s, expected one of %v", c.SourceDistro, c.Repo.Distributions)
+		}
+		if c.SourceComponent != "" && !validCodename.MatchString(c.SourceComponent) {
+			return fmt.Errorf("source component is not valid: %q", c.SourceComponent)
+		}
+		if !c.Repo.HasComponent(c.SourceComponentOrDefault()) {
+			return fmt.Errorf("source component %s is not one of the repository components %v", c.SourceComponentOrDefault(), c.Repo.Components)
+		}
+		if c.SourceDistro == c.UbuntuDistro && c.SourceComponentOrDefault() == c.ComponentFor(c.UbuntuDistro) {
+			return fmt.Errorf("source and target of promote are both %s/%s", c.SourceDistro, c.SourceComponentOrDefault())
+		}
 	}
-	if c.Architectures == nil {
-		return fmt.Errorf("architectures is required: %s", c.Architectures)
+	if (c.Command == CommandSnapshot || c.Command == CommandRollback) && !validCodename.MatchString(c.SnapshotName) {
+		return fmt.Errorf("snapshot name is not valid: %q", c.SnapshotName)
 	}
-	if len(c.Architectures) <= 0 {
-		return fmt.Errorf("architectures is required: %s", c.Architectures)
+	if c.Command == CommandRemove && c.PackageName == "" && c.Filter == "" {
+		return fmt.Errorf("package name or filter is required")
+	}
+	if _, err := deb.ParseFilter(c.Filter); err != nil {
+		return fmt.Errorf("filter is not valid: %v", err)
+	}
+	if !slices.Contains(validFormats, c.Format) {
+		return fmt.Errorf("format is not valid: %s", c.Format)
+	}
+	if !slices.Contains(validLayouts, c.Layout) {
+		return fmt.Errorf("layout is not valid: %s", c.Layout)
+	}
+	if c.Command == CommandVerify && len(c.GpgPublicKey) == 0 {
+		return fmt.Errorf("gpg public key is required: %s", c.GpgPublicKey)
+	}
+	if !c.ReadOnly() {
+		if c.GpgPrivateKey == nil {
+			return fmt.Errorf("gpg private key is required: %s", c.GpgPrivateKey)
+		}
+		if len(c.GpgPrivateKey) == 0 {
+			return fmt.Errorf("gpg private key is required: %s", c.GpgPrivateKey)
+		}
+	}
+	if c.MinAge < 0 {
+		return fmt.Errorf("min age must not be negative: %s", c.MinAge)
+	}
+	return nil
+}
+
+// CheckSettings checks the settings that configure the storage and the run
+// itself, so that they can be checked before the storage is used.
+func (c *Config) CheckSettings() error {
+	if !slices.Contains(validCommands, c.Command) {
+		return fmt.Errorf("command is not valid: %s", c.Command)
 	}
 	if !slices.Contains(validStorageTypes, c.StorageType) {
 		return fmt.Errorf("storage type is not valid: %s", c.StorageType)
 	}
+	if !slices.Contains(validSymlinkStrategies[c.StorageType], c.SymlinkStrategy) {
+		return fmt.Errorf("symlink strategy is not valid for storage type %s: %s", c.StorageType, c.SymlinkStrategy)
+	}
 	if c.Endpoint == "" {
 		return fmt.Errorf("endpoint is required: %s", c.Endpoint)
 	}
 	if c.BucketName == "" {
 		return fmt.Errorf("bucket name is required: %s", c.BucketName)
 	}
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base url is not valid: %q, expected an http or https URL", c.BaseURL)
+		}
+	}
 	if c.AccessKeyId == "" {
 		return fmt.Errorf("access key id is required: %s", c.AccessKeyId)
 	}
 	if c.AccessKeySecret == "" {
 		return fmt.Errorf("access key secret is required: %s", c.AccessKeySecret)
 	}
-	if c.GpgPrivateKey == nil {
-		return fmt.Errorf("gpg private key is required: %s", c.GpgPrivateKey)
+	if c.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1: %d", c.Concurrency)
+	}
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1: %d", c.RetryAttempts)
 	}
-	if len(c.GpgPrivateKey) == 0 {
-		return fmt.Errorf("gpg private key is required: %s", c.GpgPrivateKey)
+	if c.RetryBackoff <= 0 {
+		return fmt.Errorf("retry backoff must be positive: %s", c.RetryBackoff)
 	}
 	return nil
 }
 
+// ReadOnly reports whether the command only reads the repository, and so
+// needs neither the lock nor a signing key.
+func (c *Config) ReadOnly() bool {
+	return c.Command == CommandList || c.Command == CommandVerify
+}
+
+// ComponentFor returns the component that packages for distro are published
+// to, main for a single distro and stable for all distros unless configured.
+func (c *Config) ComponentFor(distro string) string {
+	if c.Component != "" {
+		return c.Component
+	}
+	if distro == AllDistros {
+		return defaultAllComponent
+	}
+	return defaultComponent
+}
+
+// SourceComponentOrDefault returns the component that promote copies
+// packages from.
+func (c *Config) SourceComponentOrDefault() string {
+	if c.SourceComponent != "" {
+		return c.SourceComponent
+	}
+	return defaultComponent
+}
+
 type SingleConfig struct {
 	UbuntuDistro string
 	DebPath      string
 	Architecture string
 	Container    string
+	Layout       string
 }
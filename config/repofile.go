@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RepoFileName is the name of the repository config file, looked up in the
+// working directory and then at the root of the bucket.
+const RepoFileName = "apt-repo.yaml"
+
+// RepoFileVersion is the only version of the repository config file this
+// release understands.
+const RepoFileVersion = 1
+
+// RepoFile is the versioned repository config file. Every setting it leaves
+// out keeps the value of the run.
+type RepoFile struct {
+	Version         int `yaml:"version"`
+	RepoConfig      `yaml:",inline"`
+	Layout          string          `yaml:"layout"`
+	SymlinkStrategy string          `yaml:"symlink_strategy"`
+	Retention       RetentionConfig `yaml:"retention"`
+	Storage         StorageConfig   `yaml:"storage"`
+}
+
+// RetentionConfig holds the defaults of gc.
+type RetentionConfig struct {
+	MinAge *time.Duration `yaml:"min_age"`
+}
+
+// StorageConfig holds the defaults of the storage settings, which a run
+// may override, e.g. to reach the bucket through another endpoint.
+type StorageConfig struct {
+	Type     string `yaml:"type"`
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+}
+
+// ParseRepoFile parses and validates a repository config file. Unknown
+// settings are errors, so that a typo never silently falls back to the
+// defaults.
+func ParseRepoFile(content []byte) (*RepoFile, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	var file RepoFile
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if file.Version == 0 {
+		return nil, fmt.Errorf("version is required, the current version is %d", RepoFileVersion)
+	}
+	if file.Version != RepoFileVersion {
+		return nil, fmt.Errorf("version %d is not supported, expected %d", file.Version, RepoFileVersion)
+	}
+	if file.Layout != "" && !slices.Contains(validLayouts, file.Layout) {
+		return nil, fmt.Errorf("layout is not valid: %q, expected one of %v", file.Layout, validLayouts)
+	}
+	if file.Storage.Type != "" && !slices.Contains(validStorageTypes, file.Storage.Type) {
+		return nil, fmt.Errorf("storage type is not valid: %q, expected one of %v", file.Storage.Type, validStorageTypes)
+	}
+	if file.Retention.MinAge != nil && *file.Retention.MinAge < 0 {
+		return nil, fmt.Errorf("retention min_age must not be negative: %s", *file.Retention.MinAge)
+	}
+	// Distributions the file leaves to the run are checked once applied.
+	repo := file.RepoConfig
+	if len(repo.Distributions) == 0 {
+		repo.Distributions = slices.Concat(repo.AllDistributions, slices.Collect(maps.Values(repo.Suites)))
+	}
+	if len(repo.Distributions) == 0 {
+		repo.Distributions = defaultDistributions
+	}
+	if err := repo.IsValid(); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// Apply overrides the repository-wide settings of cfg with those the file
+// sets, and fills in the storage settings and retention cfg leaves empty.
+func (f *RepoFile) Apply(cfg *Config, minAgeSet bool) {
+	repo := &cfg.Repo
+	for _, field := range []struct {
+		value *string
+		file  string
+	}{
+		{&repo.Origin, f.Origin},
+		{&repo.Label, f.Label},
+		{&repo.Description, f.Description},
+		{&repo.Signing.PublicKey, f.Signing.PublicKey},
+		{&repo.Signing.Fingerprint, f.Signing.Fingerprint},
+		{&cfg.Layout, f.Layout},
+		{&cfg.SymlinkStrategy, f.SymlinkStrategy},
+	} {
+		if field.file != "" {
+			*field.value = field.file
+		}
+	}
+	if len(f.Distributions) > 0 {
+		repo.Distributions = f.Distributions
+		repo.AllDistributions = f.Distributions
+	}
+	if len(f.AllDistributions) > 0 {
+		repo.AllDistributions = f.AllDistributions
+	}
+	if len(f.Suites) > 0 {
+		repo.Suites = f.Suites
+	}
+	if len(f.Components) > 0 {
+		repo.Components = f.Components
+	}
+	if len(f.Architectures) > 0 {
+		repo.Architectures = f.Architectures
+	}
+	if len(f.Compressions) > 0 {
+		repo.Compressions = f.Compressions
+	}
+
+	for _, field := range []struct {
+		value *string
+		file  string
+	}{
+		{&cfg.StorageType, f.Storage.Type},
+		{&cfg.Endpoint, f.Storage.Endpoint},
+		{&cfg.Region, f.Storage.Region},
+		{&cfg.BucketName, f.Storage.Bucket},
+	} {
+		if *field.value == "" {
+			*field.value = field.file
+		}
+	}
+	if f.Retention.MinAge != nil && !minAgeSet {
+		cfg.MinAge = *f.Retention.MinAge
+	}
+	if len(cfg.GpgPublicKey) == 0 && f.Signing.PublicKey != "" {
+		cfg.GpgPublicKey = []byte(f.Signing.PublicKey)
+	}
+}
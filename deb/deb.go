@@ -7,7 +7,6 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
 
@@ -17,6 +16,7 @@ import (
 
 type DebFileInfo struct {
 	Name          string
+	Source        string
 	Version       string
 	Architecture  string
 	Maintainer    string
@@ -36,6 +36,9 @@ func (p *DebFileInfo) Format() string {
 	var content strings.Builder
 
 	fmt.Fprintf(&content, "Package: %s\n", p.Name)
+	if p.Source != "" {
+		fmt.Fprintf(&content, "Source: %s\n", p.Source)
+	}
 	fmt.Fprintf(&content, "Version: %s\n", p.Version)
 	fmt.Fprintf(&content, "Architecture: %s\n", p.Architecture)
 	fmt.Fprintf(&content, "Maintainer: %s\n", p.Maintainer)
@@ -64,7 +67,56 @@ func (p *DebFileInfo) Format() string {
 	return content.String()
 }
 
-func GetInfoFromDebFile(file *os.File) (*DebFileInfo, error) {
+// SourceName returns the name of the source package, which is the binary
+// package name unless the Source field says otherwise. A version in
+// parentheses after the source name is dropped.
+func (p *DebFileInfo) SourceName() string {
+	if p.Source == "" {
+		return p.Name
+	}
+	name, _, _ := strings.Cut(p.Source, " ")
+	return name
+}
+
+// Field returns the value of a control field by its name in a Packages
+// stanza, ignoring case, and whether the field is known.
+func (p *DebFileInfo) Field(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case "package":
+		return p.Name, true
+	case "source":
+		return p.SourceName(), true
+	case "version":
+		return p.Version, true
+	case "architecture":
+		return p.Architecture, true
+	case "maintainer":
+		return p.Maintainer, true
+	case "installed-size":
+		return p.InstalledSize, true
+	case "depends":
+		return p.Depends, true
+	case "filename":
+		return p.Filename, true
+	case "size":
+		return strconv.FormatInt(p.Size, 10), true
+	case "md5sum":
+		return p.MD5sum, true
+	case "sha1":
+		return p.SHA1, true
+	case "sha256":
+		return p.SHA256, true
+	case "section":
+		return p.Section, true
+	case "priority":
+		return p.Priority, true
+	case "description":
+		return p.Description, true
+	}
+	return "", false
+}
+
+func GetInfoFromDebFile(file io.ReadSeeker) (*DebFileInfo, error) {
 	arHeader := make([]byte, 8)
 	if _, err := io.ReadFull(file, arHeader); err != nil {
 		return nil, fmt.Errorf("failed to read ar header: %v", err)
@@ -215,6 +267,8 @@ func GetInfoFromDebFile(file *os.File) (*DebFileInfo, error) {
 		switch parts[0] {
 		case "Package":
 			debInfo.Name = parts[1]
+		case "Source":
+			debInfo.Source = parts[1]
 		case "Version":
 			debInfo.Version = parts[1]
 		case "Architecture":
@@ -293,6 +347,8 @@ func ParsePackagesFile(reader io.Reader) map[string]*DebFileInfo {
 		switch parts[0] {
 		case "Package":
 			currentPackage.Name = parts[1]
+		case "Source":
+			currentPackage.Source = parts[1]
 		case "Version":
 			currentPackage.Version = parts[1]
 		case "Architecture":
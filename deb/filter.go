@@ -0,0 +1,99 @@
+package deb
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter selects packages by their control fields. Its expression is a list
+// of alternatives separated by |, each a list of conditions separated by
+// commas that must all hold, e.g.
+//
+//	Package = foo, Version << 1.2 | Package ~ foo-*
+//
+// A condition is a field name, one of the operators =, !=, ~ (shell
+// pattern), <<, <=, >= and >> (Debian version ordering), and a value. The
+// empty filter matches every package.
+type Filter [][]condition
+
+type condition struct {
+	field string
+	op    string
+	value string
+}
+
+var conditionPattern = regexp.MustCompile(`^([A-Za-z0-9-]+)\s*(!=|<<|<=|>=|>>|=|~)\s*(.*)$`)
+
+// ParseFilter parses a filter expression.
+func ParseFilter(expr string) (Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	var f Filter
+	for _, alternative := range strings.Split(expr, "|") {
+		var conditions []condition
+		for _, c := range strings.Split(alternative, ",") {
+			c = strings.TrimSpace(c)
+			m := conditionPattern.FindStringSubmatch(c)
+			if m == nil {
+				return nil, fmt.Errorf("invalid condition %q, expected <field> <operator> <value>", c)
+			}
+			if _, ok := (&DebFileInfo{}).Field(m[1]); !ok {
+				return nil, fmt.Errorf("unknown field %q in condition %q", m[1], c)
+			}
+			if m[2] == "~" {
+				if _, err := path.Match(m[3], ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern in condition %q: %v", c, err)
+				}
+			}
+			conditions = append(conditions, condition{m[1], m[2], m[3]})
+		}
+		f = append(f, conditions)
+	}
+	return f, nil
+}
+
+// Match reports whether a package satisfies any alternative of the filter.
+func (f Filter) Match(p *DebFileInfo) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, conditions := range f {
+		matched := true
+		for _, c := range conditions {
+			if !c.match(p) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c condition) match(p *DebFileInfo) bool {
+	value, _ := p.Field(c.field)
+	switch c.op {
+	case "=":
+		return value == c.value
+	case "!=":
+		return value != c.value
+	case "~":
+		matched, _ := path.Match(c.value, value)
+		return matched
+	case "<<":
+		return CompareVersions(value, c.value) < 0
+	case "<=":
+		return CompareVersions(value, c.value) <= 0
+	case ">=":
+		return CompareVersions(value, c.value) >= 0
+	case ">>":
+		return CompareVersions(value, c.value) > 0
+	}
+	return false
+}
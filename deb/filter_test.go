@@ -0,0 +1,53 @@
+package deb
+
+import "testing"
+
+func TestFilterMatch(t *testing.T) {
+	foo := &DebFileInfo{Name: "foo", Version: "1.2-1", Architecture: "amd64", Source: "foo-src"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"Package = foo", true},
+		{"Package != foo", false},
+		{"Package ~ fo*", true},
+		{"Package ~ bar*", false},
+		{"Version << 1.2-2", true},
+		{"Version <= 1.2-1", true},
+		{"Version >= 1.2~rc1", true},
+		{"Version >> 1.2", true},
+		{"Version >> 1:1.0", false},
+		{"Source = foo-src", true},
+		{"Package = foo, Architecture = arm64", false},
+		{"Package = bar | Architecture = amd64", true},
+		{"Package = bar, Architecture = amd64 | Package = foo, Version << 1.0", false},
+		{"Package = bar | Package = foo, Version >> 1.0", true},
+		{"Section = utils", false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(foo); got != tt.want {
+			t.Errorf("filter %q matched = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"Package",
+		"Package foo",
+		"Colour = red",
+		"Package = foo,",
+		"Package = foo | ",
+		"Package ~ [",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded, want an error", expr)
+		}
+	}
+}
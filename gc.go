@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// maxLinkDepth bounds how many links gc follows from a referenced file, in
+// case links were ever written in a cycle.
+const maxLinkDepth = 8
+
+// gc deletes the package files under dists/ and pool/ that no Packages
+// index references, including indexes under by-hash directories and those
+// of snapshots, so that rollback does not have to restore them, along with
+// the _latest_ aliases of packages no longer published next to them, or by
+// any distro for the aliases of uploads for all distros. Files
+// that links of referenced files resolve to are kept, and so is everything
+// modified within cfg.MinAge.
+func gc(storageProvider storage.StorageProvider, cfg *config.Config) error {
+	logging.Group("Scan repository")
+	objects, err := storageProvider.ListObjects(cfg.BucketName, "")
+	if err != nil {
+		return fmt.Errorf("list repository failed: %v", err)
+	}
+
+	var referenced []string
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		if path.Base(obj.Key) != "Packages" && !strings.Contains(obj.Key, "/by-hash/") {
+			continue
+		}
+		packages, err := readPackagesIndex(storageProvider, cfg.BucketName, obj.Key)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range packages {
+			if !seen[pkg.Filename] {
+				seen[pkg.Filename] = true
+				referenced = append(referenced, pkg.Filename)
+			}
+		}
+	}
+	slog.Info("found referenced package files", "count", len(referenced))
+
+	slog.Info("resolving links of referenced files")
+	keep, err := resolveLinks(storageProvider, cfg, referenced)
+	if err != nil {
+		return err
+	}
+
+	// An alias is kept while a kept package file next to it matches it.
+	dirs := make(map[string][]string)
+	for key := range keep {
+		dirs[path.Dir(key)] = append(dirs[path.Dir(key)], path.Base(key))
+	}
+	// Uploads for all distros keep their alias under dists/all/, which no
+	// index references when the distros hold copies of the file, so such an
+	// alias is kept while any distro publishes a matching file in the same
+	// component and architecture.
+	published := make(map[string][]string)
+	for _, key := range referenced {
+		if rest, ok := strings.CutPrefix(key, "dists/"); ok {
+			if _, dir, ok := strings.Cut(path.Dir(rest), "/"); ok {
+				published[dir] = append(published[dir], path.Base(key))
+			}
+		}
+	}
+	var candidates []storage.ObjectInfo
+	var aliases []string
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, "dists/") && !strings.HasPrefix(obj.Key, "pool/") {
+			continue
+		}
+		if keep[obj.Key] {
+			continue
+		}
+		// Aliases are named <pkg>_latest_<arch>.deb, so they are told apart
+		// from package files before the .deb suffix is checked.
+		if pkg, arch, ok := strings.Cut(path.Base(obj.Key), "_latest_"); ok {
+			files := dirs[path.Dir(obj.Key)]
+			if dir, ok := strings.CutPrefix(path.Dir(obj.Key), "dists/"+config.AllDistros+"/"); ok {
+				files = slices.Concat(files, published[dir])
+			}
+			if latestAliasInUse(files, pkg, strings.TrimSuffix(arch, ".deb")) {
+				aliases = append(aliases, obj.Key)
+				continue
+			}
+			candidates = append(candidates, obj)
+			continue
+		}
+		if strings.HasSuffix(obj.Key, ".deb") {
+			candidates = append(candidates, obj)
+		}
+	}
+	aliasTargets, err := resolveLinks(storageProvider, cfg, aliases)
+	if err != nil {
+		return err
+	}
+	for key := range aliasTargets {
+		keep[key] = true
+	}
+
+	cutoff := time.Now().Add(-cfg.MinAge)
+	var obsolete []string
+	var reclaimed int64
+	recent := 0
+	for _, obj := range candidates {
+		if keep[obj.Key] {
+			continue
+		}
+		if obj.LastModified.After(cutoff) {
+			recent++
+			continue
+		}
+		obsolete = append(obsolete, obj.Key)
+		reclaimed += obj.Size
+	}
+	slices.Sort(obsolete)
+
+	logging.Group("Delete unreferenced objects")
+	for _, key := range obsolete {
+		slog.Info("unreferenced object", "key", key)
+	}
+	if recent > 0 {
+		slog.Info("keeping recently modified unreferenced objects", "count", recent, "min_age", cfg.MinAge)
+	}
+
+	// In a dry run the deletions go to the recorder, which adds them to the
+	// plan.
+	if len(obsolete) > 0 {
+		if err := deleteObjects(storageProvider, cfg.BucketName, obsolete, cfg.Concurrency); err != nil {
+			return err
+		}
+	}
+
+	if cfg.DryRun {
+		slog.Info("would reclaim storage", "objects", len(obsolete), "size", formatBytes(reclaimed))
+	} else {
+		slog.Info("reclaimed storage", "objects", len(obsolete), "size", formatBytes(reclaimed))
+	}
+	return nil
+}
+
+// readPackagesIndex parses a Packages index, which under by-hash may also be
+// gzip compressed. Other compressions are not used by this repository and
+// are skipped.
+func readPackagesIndex(storageProvider storage.StorageProvider, bucketName, key string) (map[string]*deb.DebFileInfo, error) {
+	content, err := storageProvider.GetObject(bucketName, key)
+	if err != nil {
+		return nil, fmt.Errorf("get %s failed: %v", key, err)
+	}
+	if bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("decompress %s failed: %v", key, err)
+		}
+		defer reader.Close()
+		return deb.ParsePackagesFile(reader), nil
+	}
+	return deb.ParsePackagesFile(bytes.NewReader(content)), nil
+}
+
+// latestAliasInUse reports whether a <pkg>_latest_<arch> alias still
+// belongs to one of the given package files in its directory.
+func latestAliasInUse(files []string, pkg, arch string) bool {
+	return slices.ContainsFunc(files, func(base string) bool {
+		return strings.HasPrefix(base, pkg+"_") && strings.HasSuffix(base, "_"+arch+".deb")
+	})
+}
+
+// resolveLinks returns the set of keys, and the objects their links point
+// at, that gc must keep.
+func resolveLinks(storageProvider storage.StorageProvider, cfg *config.Config, keys []string) (map[string]bool, error) {
+	keep := make(map[string]bool)
+	var mu sync.Mutex
+	err := runParallel(cfg.Concurrency, len(keys), func(i int, log *slog.Logger) error {
+		key := keys[i]
+		for depth := 0; depth < maxLinkDepth && key != ""; depth++ {
+			mu.Lock()
+			keep[key] = true
+			mu.Unlock()
+
+			target, err := storageProvider.GetSymlinkTarget(cfg.BucketName, key)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return fmt.Errorf("read link %s failed: %v", key, err)
+			}
+			key = target
+		}
+		return nil
+	})
+	return keep, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB (%d bytes)", float64(n)/float64(div), "KMGTPE"[exp], n)
+}
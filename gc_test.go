@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/storage/storagetest"
+)
+
+func TestGCLatestAliases(t *testing.T) {
+	const dir = "dists/jammy/main/binary-amd64/"
+	sp := storagetest.NewMemory()
+	packages := map[string]*deb.DebFileInfo{
+		"foo": {Name: "foo", Version: "1.0", Architecture: "amd64", Filename: dir + "foo_1.0_amd64.deb"},
+	}
+	sp.PutObject("", dir+"Packages", []byte(formatPackages(packages)))
+	sp.PutObject("", dir+"foo_1.0_amd64.deb", []byte("foo"))
+	sp.CreateSymlink("", dir+"foo_1.0_amd64.deb", dir+"foo_latest_amd64.deb")
+	sp.PutObject("", dir+"bar_0.9_amd64.deb", []byte("bar"))
+	sp.CreateSymlink("", dir+"bar_0.9_amd64.deb", dir+"bar_latest_amd64.deb")
+	sp.Age(48 * time.Hour)
+
+	cfg := &config.Config{MinAge: 24 * time.Hour, Concurrency: 2}
+	if err := gc(sp, cfg); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+
+	want := []string{dir + "Packages", dir + "foo_1.0_amd64.deb", dir + "foo_latest_amd64.deb"}
+	if got := sp.Keys(); !slices.Equal(got, want) {
+		t.Errorf("gc kept %v, want %v", got, want)
+	}
+}
+
+func TestLatestAliasInUse(t *testing.T) {
+	files := []string{"foo_1.0_amd64.deb", "foo-dbg_1.0_arm64.deb"}
+	tests := []struct {
+		pkg, arch string
+		want      bool
+	}{
+		{"foo", "amd64", true},
+		{"foo", "arm64", false},
+		{"foo-dbg", "arm64", true},
+		{"bar", "amd64", false},
+	}
+	for _, tt := range tests {
+		if got := latestAliasInUse(files, tt.pkg, tt.arch); got != tt.want {
+			t.Errorf("latestAliasInUse(%s, %s) = %v, want %v", tt.pkg, tt.arch, got, tt.want)
+		}
+	}
+}
+
+func TestGCAllDistrosAliases(t *testing.T) {
+	const (
+		all   = "dists/all/main/binary-amd64/"
+		jammy = "dists/jammy/main/binary-amd64/"
+	)
+	sp := storagetest.NewMemory()
+	// With the copy strategy the distros hold copies of the upload, and its
+	// alias is a copy too.
+	sp.PutObject("", all+"foo_1.0_amd64.deb", []byte("foo"))
+	sp.PutObject("", all+"foo_latest_amd64.deb", []byte("foo"))
+	sp.PutObject("", jammy+"foo_1.0_amd64.deb", []byte("foo"))
+	sp.PutObject("", all+"bar_latest_amd64.deb", []byte("bar"))
+	packages := map[string]*deb.DebFileInfo{
+		"foo": {Name: "foo", Version: "1.0", Architecture: "amd64", Filename: jammy + "foo_1.0_amd64.deb"},
+	}
+	sp.PutObject("", jammy+"Packages", []byte(formatPackages(packages)))
+	sp.Age(48 * time.Hour)
+
+	cfg := &config.Config{MinAge: 24 * time.Hour, Concurrency: 2}
+	if err := gc(sp, cfg); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+
+	want := []string{all + "foo_latest_amd64.deb", jammy + "Packages", jammy + "foo_1.0_amd64.deb"}
+	if got := sp.Keys(); !slices.Equal(got, want) {
+		t.Errorf("gc kept %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,271 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+const (
+	journalFilePath = "apt-repo.journal"
+	backupPrefix    = "apt-repo.journal.d/"
+)
+
+// Entry records the state of one object before the current run modified it.
+// A link is recorded by its target rather than backed up, as reading it
+// would return the object it points at.
+type Entry struct {
+	Key     string `json:"key"`
+	Existed bool   `json:"existed"`
+	Backup  string `json:"backup,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// Journal is a StorageProvider that records the previous version of every
+// object it overwrites in the bucket, so that a failed publish can be rolled
+// back to the state the repository was in before the run started.
+type Journal struct {
+	storage    storage.StorageProvider
+	bucketName string
+
+	StartedAt string   `json:"started_at"`
+	Entries   []*Entry `json:"entries"`
+	recorded  map[string]*recording
+	mu        sync.Mutex
+
+	// saved is the number of entries in the journal in the bucket. Saves
+	// are serialized by saveMu, and a save covers every entry appended
+	// while the one before it was uploading.
+	saved  int
+	saveMu sync.Mutex
+}
+
+// recording tracks the backup of one object, which concurrent writes to the
+// same key wait for.
+type recording struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJournal(storage storage.StorageProvider, bucketName string) *Journal {
+	return &Journal{
+		storage:    storage,
+		bucketName: bucketName,
+		StartedAt:  time.Now().Format(time.RFC3339),
+		recorded:   make(map[string]*recording),
+	}
+}
+
+// Recover rolls back a journal left behind by a previous run that did not
+// finish, either because it crashed or because its own rollback failed.
+func (j *Journal) Recover() error {
+	content, err := j.storage.GetObject(j.bucketName, journalFilePath)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get journal file failed: %v", err)
+	}
+
+	previous := NewJournal(j.storage, j.bucketName)
+	if err := json.Unmarshal(content, previous); err != nil {
+		return fmt.Errorf("parse journal file failed: %v", err)
+	}
+	slog.Warn("found unfinished journal, restoring objects",
+		"started_at", previous.StartedAt, "objects", len(previous.Entries))
+	return previous.Rollback()
+}
+
+func (j *Journal) PutObject(bucket, key string, content []byte) error {
+	if err := j.record(bucket, key); err != nil {
+		return err
+	}
+	return j.storage.PutObject(bucket, key, content)
+}
+
+func (j *Journal) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	if err := j.record(bucket, key); err != nil {
+		return err
+	}
+	return j.storage.PutObjectIfNotExists(bucket, key, content)
+}
+
+func (j *Journal) GetObject(bucket, key string) ([]byte, error) {
+	return j.storage.GetObject(bucket, key)
+}
+
+func (j *Journal) DeleteObject(bucket, key string) error {
+	if err := j.record(bucket, key); err != nil {
+		return err
+	}
+	return j.storage.DeleteObject(bucket, key)
+}
+
+func (j *Journal) HeadObject(bucket, key string) (bool, error) {
+	return j.storage.HeadObject(bucket, key)
+}
+
+func (j *Journal) ListObjects(bucket, prefix string) ([]storage.ObjectInfo, error) {
+	return j.storage.ListObjects(bucket, prefix)
+}
+
+func (j *Journal) CreateSymlink(bucket, target, symlink string) error {
+	if err := j.record(bucket, symlink); err != nil {
+		return err
+	}
+	return j.storage.CreateSymlink(bucket, target, symlink)
+}
+
+func (j *Journal) GetSymlinkTarget(bucket, key string) (string, error) {
+	return j.storage.GetSymlinkTarget(bucket, key)
+}
+
+// Commit discards the journal, making the changes of the current run final.
+func (j *Journal) Commit() error {
+	return j.cleanup()
+}
+
+// Rollback restores every journaled object in reverse order of modification
+// and discards the journal once the bucket is back to its previous state.
+func (j *Journal) Rollback() error {
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		e := j.Entries[i]
+		if !e.Existed {
+			if err := j.storage.DeleteObject(j.bucketName, e.Key); err != nil {
+				return fmt.Errorf("delete %s failed: %v", e.Key, err)
+			}
+			continue
+		}
+		if e.Target != "" {
+			if err := j.storage.CreateSymlink(j.bucketName, e.Target, e.Key); err != nil {
+				return fmt.Errorf("restore link %s failed: %v", e.Key, err)
+			}
+			continue
+		}
+
+		content, err := j.storage.GetObject(j.bucketName, e.Backup)
+		if err != nil {
+			return fmt.Errorf("get backup of %s failed: %v", e.Key, err)
+		}
+		if err := j.storage.PutObject(j.bucketName, e.Key, content); err != nil {
+			return fmt.Errorf("restore %s failed: %v", e.Key, err)
+		}
+	}
+
+	return j.cleanup()
+}
+
+func (j *Journal) record(bucket, key string) error {
+	if bucket != j.bucketName {
+		return fmt.Errorf("journal for bucket %s cannot record changes to bucket %s", j.bucketName, bucket)
+	}
+
+	j.mu.Lock()
+	if r, ok := j.recorded[key]; ok {
+		j.mu.Unlock()
+		<-r.done
+		return r.err
+	}
+	r := &recording{done: make(chan struct{})}
+	j.recorded[key] = r
+	j.mu.Unlock()
+
+	r.err = j.backup(key)
+	if r.err != nil {
+		j.mu.Lock()
+		delete(j.recorded, key)
+		j.mu.Unlock()
+	}
+	close(r.done)
+	return r.err
+}
+
+// backup records the current state of key and saves the journal. The
+// storage calls run outside of j.mu, so that writes to other keys are not
+// held up by them.
+func (j *Journal) backup(key string) error {
+	entry := &Entry{Key: key, Existed: true}
+	target, err := j.storage.GetSymlinkTarget(j.bucketName, key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		entry.Existed = false
+	case err != nil:
+		return fmt.Errorf("check %s for backup failed: %v", key, err)
+	case target != "":
+		entry.Target = target
+	default:
+		content, err := j.storage.GetObject(j.bucketName, key)
+		if err != nil {
+			return fmt.Errorf("get %s for backup failed: %v", key, err)
+		}
+		entry.Backup = backupPrefix + key
+		if err := j.storage.PutObject(j.bucketName, entry.Backup, content); err != nil {
+			return fmt.Errorf("backup %s failed: %v", key, err)
+		}
+	}
+
+	j.mu.Lock()
+	j.Entries = append(j.Entries, entry)
+	n := len(j.Entries)
+	j.mu.Unlock()
+
+	// The journal must reach the bucket before the object is modified,
+	// otherwise a crash in between would leave a change nobody can undo.
+	return j.save(n)
+}
+
+// save uploads the journal unless a save that included its first n entries
+// has already finished.
+func (j *Journal) save(n int) error {
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+	if j.saved >= n {
+		return nil
+	}
+
+	j.mu.Lock()
+	content, err := json.Marshal(j)
+	count := len(j.Entries)
+	j.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("encode journal failed: %v", err)
+	}
+	if err := j.storage.PutObject(j.bucketName, journalFilePath, content); err != nil {
+		return fmt.Errorf("upload journal file failed: %v", err)
+	}
+	j.saved = count
+	return nil
+}
+
+func (j *Journal) cleanup() error {
+	// Drop the journal before the backups it points to, so that a failure
+	// here can never make the next run restore from a missing backup.
+	exists, err := j.storage.HeadObject(j.bucketName, journalFilePath)
+	if err != nil {
+		return fmt.Errorf("check journal file failed: %v", err)
+	}
+	if exists {
+		if err := j.storage.DeleteObject(j.bucketName, journalFilePath); err != nil {
+			return fmt.Errorf("delete journal file failed: %v", err)
+		}
+	}
+
+	for _, e := range j.Entries {
+		if e.Backup == "" {
+			continue
+		}
+		if err := j.storage.DeleteObject(j.bucketName, e.Backup); err != nil {
+			return fmt.Errorf("delete backup of %s failed: %v", e.Key, err)
+		}
+	}
+
+	j.Entries = nil
+	j.recorded = make(map[string]*recording)
+	j.saved = 0
+	return nil
+}
@@ -0,0 +1,96 @@
+package journal
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/coscene-io/update-apt-source/storage/storagetest"
+)
+
+func TestRollbackRestoresLinks(t *testing.T) {
+	const (
+		deb   = "dists/jammy/main/binary-amd64/foo_1.0_amd64.deb"
+		next  = "dists/jammy/main/binary-amd64/foo_1.1_amd64.deb"
+		alias = "dists/jammy/main/binary-amd64/foo_latest_amd64.deb"
+		index = "dists/jammy/main/binary-amd64/Packages"
+	)
+	sp := storagetest.NewMemory()
+	sp.PutObject("bucket", deb, []byte("1.0"))
+	sp.CreateSymlink("bucket", deb, alias)
+	sp.PutObject("bucket", index, []byte("old"))
+
+	j := NewJournal(sp, "bucket")
+	if err := j.PutObject("bucket", next, []byte("1.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CreateSymlink("bucket", next, alias); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.PutObject("bucket", index, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Rollback(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	if target, err := sp.GetSymlinkTarget("bucket", alias); err != nil || target != deb {
+		t.Errorf("alias points at %q (%v), want a link to %s", target, err, deb)
+	}
+	if content, _ := sp.GetObject("bucket", index); string(content) != "old" {
+		t.Errorf("index is %q, want old", content)
+	}
+	want := []string{deb, alias, index}
+	slices.Sort(want)
+	if got := sp.Keys(); !slices.Equal(got, want) {
+		t.Errorf("bucket holds %v after rollback, want %v", got, want)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	sp := storagetest.NewMemory()
+	var want []string
+	for i := range 16 {
+		key := fmt.Sprintf("dists/jammy/main/binary-amd64/foo_%d_amd64.deb", i)
+		sp.PutObject("bucket", key, []byte("old"))
+		want = append(want, key)
+	}
+	slices.Sort(want)
+
+	j := NewJournal(sp, "bucket")
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(want))
+	for _, key := range want {
+		// Two writes to each key, of which only the first is journaled.
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- j.PutObject("bucket", key, []byte("new"))
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(j.Entries) != len(want) {
+		t.Errorf("journal has %d entries, want %d", len(j.Entries), len(want))
+	}
+
+	if err := j.Rollback(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	for _, key := range want {
+		if content, _ := sp.GetObject("bucket", key); string(content) != "old" {
+			t.Errorf("%s is %q after rollback, want old", key, content)
+		}
+	}
+	if got := sp.Keys(); !slices.Equal(got, want) {
+		t.Errorf("bucket holds %v after rollback, want %v", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// listedPackage is one Packages entry as printed by list.
+type listedPackage struct {
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Distro       string `json:"distro"`
+	Component    string `json:"component"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	Filename     string `json:"filename"`
+}
+
+// list prints the packages published in the selected distros and
+// components that match the package name, version, architectures and
+// filter of cfg, as a table or as JSON.
+func list(storageProvider storage.StorageProvider, cfg *config.Config, out io.Writer) error {
+	matches, err := packageMatcher(cfg)
+	if err != nil {
+		return err
+	}
+	targets := selectedDistros(cfg)
+
+	objects, err := storageProvider.ListObjects(cfg.BucketName, "dists/")
+	if err != nil {
+		return fmt.Errorf("list repository failed: %v", err)
+	}
+
+	listed := []listedPackage{}
+	for _, obj := range objects {
+		distro, dir, ok := splitPackagesKey(obj.Key)
+		if !ok || !slices.Contains(targets, distro) {
+			continue
+		}
+		component, _, _ := strings.Cut(dir, "/binary-")
+		if cfg.Component != "" && component != cfg.Component {
+			continue
+		}
+
+		content, err := storageProvider.GetObject(cfg.BucketName, obj.Key)
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", obj.Key, err)
+		}
+		for _, pkg := range deb.ParsePackagesFile(bytes.NewReader(content)) {
+			if !matches(pkg) {
+				continue
+			}
+			listed = append(listed, listedPackage{
+				Package:      pkg.Name,
+				Version:      pkg.Version,
+				Architecture: pkg.Architecture,
+				Distro:       distro,
+				Component:    component,
+				Size:         pkg.Size,
+				SHA256:       pkg.SHA256,
+				Filename:     pkg.Filename,
+			})
+		}
+	}
+	slices.SortFunc(listed, func(a, b listedPackage) int {
+		return cmp.Or(
+			cmp.Compare(a.Distro, b.Distro),
+			cmp.Compare(a.Component, b.Component),
+			cmp.Compare(a.Package, b.Package),
+			cmp.Compare(a.Architecture, b.Architecture),
+		)
+	})
+
+	if cfg.Format == config.FormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listed)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tVERSION\tARCH\tDISTRO\tCOMPONENT\tSIZE\tSHA256")
+	for _, p := range listed {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			p.Package, p.Version, p.Architecture, p.Distro, p.Component, p.Size, p.SHA256)
+	}
+	return w.Flush()
+}
+
+// packageMatcher returns a function that reports whether a package matches
+// the package name, version, architectures and filter of cfg, each of which
+// is ignored when empty.
+func packageMatcher(cfg *config.Config) (func(pkg *deb.DebFileInfo) bool, error) {
+	filter, err := deb.ParseFilter(cfg.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("parse filter failed: %v", err)
+	}
+	return func(pkg *deb.DebFileInfo) bool {
+		if cfg.PackageName != "" && pkg.Name != cfg.PackageName {
+			return false
+		}
+		if cfg.PackageVersion != "" && pkg.Version != cfg.PackageVersion {
+			return false
+		}
+		if len(cfg.Architectures) > 0 && !slices.Contains(cfg.Architectures, pkg.Architecture) {
+			return false
+		}
+		return filter.Match(pkg)
+	}, nil
+}
+
+// selectedDistros returns the distros a query command works on: the
+// configured distro, or every distribution for all. Suite aliases are
+// mirrors of their codename and never selected on their own.
+func selectedDistros(cfg *config.Config) []string {
+	if cfg.UbuntuDistro == config.AllDistros {
+		return cfg.Repo.Distributions
+	}
+	return []string{cfg.UbuntuDistro}
+}
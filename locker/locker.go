@@ -1,7 +1,9 @@
 package locker
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/coscene-io/update-apt-source/storage"
@@ -19,7 +21,6 @@ type Locker struct {
 }
 
 func NewLocker(storage storage.StorageProvider, bucketName string) *Locker {
-	fmt.Println("\nInitializing lock manager... ✓")
 	return &Locker{
 		storage:    storage,
 		bucketName: bucketName,
@@ -29,61 +30,48 @@ func NewLocker(storage storage.StorageProvider, bucketName string) *Locker {
 func (l *Locker) Lock() error {
 	lockContent := fmt.Sprintf("Locked by process at %s", time.Now().Format(time.RFC3339))
 
-	// Check if the lock file exists
-	exists, err := l.storage.HeadObject(l.bucketName, lockFilePath)
-	if err != nil {
-		return fmt.Errorf("❌ Check lock file failed: %v", err)
-	}
-
-	if exists {
-		fmt.Println("  ⏳ Lock file exists, waiting for release...")
+	// Create the lock file only if it does not exist yet, so that two
+	// processes can never both believe they hold the lock
+	err := l.storage.PutObjectIfNotExists(l.bucketName, lockFilePath, []byte(lockContent))
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		slog.Info("lock file exists, waiting for release", "max_wait", maxLockWait)
 		deadline := time.Now().Add(maxLockWait)
 
 		for time.Now().Before(deadline) {
 			time.Sleep(lockCheckInterval)
 
-			exists, err = l.storage.HeadObject(l.bucketName, lockFilePath)
-			if err != nil {
-				return fmt.Errorf("❌ Check lock file failed: %v", err)
-			}
-
-			if !exists {
+			err = l.storage.PutObjectIfNotExists(l.bucketName, lockFilePath, []byte(lockContent))
+			if !errors.Is(err, storage.ErrPreconditionFailed) {
 				break
 			}
 
-			fmt.Println("  ⏳ Lock file still exists, continue waiting...")
+			slog.Info("lock file still exists, waiting")
 		}
-		if exists {
-			return fmt.Errorf("❌ Wait for lock release timeout (%v)", maxLockWait)
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			return fmt.Errorf("wait for lock release timeout (%v)", maxLockWait)
 		}
 	}
-
-	err = l.storage.PutObject(l.bucketName, lockFilePath, []byte(lockContent))
+	if errors.Is(err, storage.ErrAccessDenied) {
+		return fmt.Errorf("create lock file failed, check the bucket permissions: %v", err)
+	}
 	if err != nil {
-		return fmt.Errorf("❌ Create lock file failed: %v", err)
+		return fmt.Errorf("create lock file failed: %v", err)
 	}
 
-	fmt.Println("\n🔒 APT source repository locked!")
+	slog.Info("repository locked", "bucket", l.bucketName)
 	return nil
 }
 
 func (l *Locker) Unlock() error {
-	// Check if the lock file exists
-	exists, err := l.storage.HeadObject(l.bucketName, lockFilePath)
-	if err != nil {
-		return fmt.Errorf("❌ Check lock file failed: %v", err)
-	}
-
-	if !exists {
+	err := l.storage.DeleteObject(l.bucketName, lockFilePath)
+	if errors.Is(err, storage.ErrNotFound) {
 		// The lock file does not exist, no action needed
 		return nil
 	}
-
-	err = l.storage.DeleteObject(l.bucketName, lockFilePath)
 	if err != nil {
-		return fmt.Errorf("❌ Delete lock file failed: %v", err)
+		return fmt.Errorf("delete lock file failed: %v", err)
 	}
 
-	fmt.Println("\n🔓 APT source repository unlocked!")
+	slog.Info("repository unlocked", "bucket", l.bucketName)
 	return nil
 }
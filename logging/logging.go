@@ -0,0 +1,258 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var validFormats = []string{
+	FormatText,
+	FormatJSON,
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are substrings of attribute keys whose values are never
+// logged, whatever they hold.
+var sensitiveKeys = []string{
+	"secret",
+	"password",
+	"token",
+	"private_key",
+	"access_key",
+}
+
+var (
+	mu      sync.RWMutex
+	format  = FormatText
+	level   = new(slog.LevelVar)
+	github  = os.Getenv("GITHUB_ACTIONS") == "true"
+	secrets []string
+	grouped bool
+
+	// commands receives the workflow commands. The runner reads them from
+	// stderr as well as from stdout, which is left to the output of list
+	// and of dry runs, so that redirecting it never captures a command or
+	// the secrets that are masked with one.
+	commands io.Writer = os.Stderr
+)
+
+// Setup makes the default slog logger write records of at least the given
+// level to stderr in the given format. Running as a GitHub Action, errors
+// and warnings are also written as workflow annotations.
+func Setup(logFormat, logLevel string) error {
+	if logFormat == "" {
+		logFormat = FormatText
+	}
+	if !slices.Contains(validFormats, logFormat) {
+		return fmt.Errorf("log format is not valid: %s, expected one of %v", logFormat, validFormats)
+	}
+	if logLevel != "" {
+		if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+			return fmt.Errorf("log level is not valid: %s, expected debug, info, warn or error", logLevel)
+		}
+	}
+
+	mu.Lock()
+	format = logFormat
+	mu.Unlock()
+	slog.SetDefault(New(os.Stderr))
+	return nil
+}
+
+// New returns a logger with the configured format and level that writes to
+// w, for output that is buffered before it reaches stderr.
+func New(w io.Writer) *slog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var handler slog.Handler
+	options := &slog.HandlerOptions{Level: level}
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	if github {
+		handler = &annotationHandler{next: handler}
+	}
+	return slog.New(&redactHandler{next: handler})
+}
+
+// AddSecret registers a value that must never be logged, such as an access
+// key or a signing key. Each line of a multiline value is registered on its
+// own, and a GitHub Action also masks them in the rest of the job output.
+func AddSecret(value string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		// Short lines, such as the armor headers of a key, are not secret
+		// and would redact unrelated text.
+		if len(line) < 8 || strings.HasPrefix(line, "-----") || slices.Contains(secrets, line) {
+			continue
+		}
+		secrets = append(secrets, line)
+		if github {
+			fmt.Fprintf(commands, "::add-mask::%s\n", line)
+		}
+	}
+}
+
+// Group starts a collapsible group of log lines when running as a GitHub
+// Action, and logs its title otherwise. Groups do not nest, so a group ends
+// the one before it.
+func Group(title string) {
+	if !github {
+		slog.Info(title)
+		return
+	}
+	EndGroup()
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintf(commands, "::group::%s\n", escape(redactLocked(title)))
+	grouped = true
+}
+
+// EndGroup ends the current group, if any.
+func EndGroup() {
+	mu.Lock()
+	defer mu.Unlock()
+	if grouped {
+		fmt.Fprintf(commands, "::endgroup::\n")
+		grouped = false
+	}
+}
+
+func redact(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return redactLocked(s)
+}
+
+func redactLocked(s string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	return slices.ContainsFunc(sensitiveKeys, func(k string) bool {
+		return strings.Contains(key, k)
+	})
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redact(value.String()))
+	case slog.KindGroup:
+		attrs := value.Group()
+		redactedAttrs := make([]any, len(attrs))
+		for i, attr := range attrs {
+			redactedAttrs[i] = redactAttr(attr)
+		}
+		return slog.Group(a.Key, redactedAttrs...)
+	case slog.KindAny:
+		// Errors and other values are logged by their text, which may
+		// quote a secret.
+		return slog.String(a.Key, redact(fmt.Sprint(value.Any())))
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
+
+// redactHandler removes secrets from the message and attributes of every
+// record before it reaches the next handler.
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	record := slog.NewRecord(r.Time, r.Level, redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		record.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, record)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name)}
+}
+
+// annotationHandler writes errors and warnings as GitHub workflow commands,
+// which the runner picks up, before passing them on.
+type annotationHandler struct {
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *annotationHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *annotationHandler) Handle(ctx context.Context, r slog.Record) error {
+	command := ""
+	switch {
+	case r.Level >= slog.LevelError:
+		command = "error"
+	case r.Level >= slog.LevelWarn:
+		command = "warning"
+	}
+	if command != "" {
+		var message strings.Builder
+		message.WriteString(r.Message)
+		for _, a := range h.attrs {
+			fmt.Fprintf(&message, " %s=%v", a.Key, a.Value)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			fmt.Fprintf(&message, " %s=%v", a.Key, a.Value)
+			return true
+		})
+		fmt.Fprintf(commands, "::%s::%s\n", command, escape(message.String()))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *annotationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &annotationHandler{next: h.next.WithAttrs(attrs), attrs: slices.Concat(h.attrs, attrs)}
+}
+
+func (h *annotationHandler) WithGroup(name string) slog.Handler {
+	return &annotationHandler{next: h.next.WithGroup(name), attrs: h.attrs}
+}
+
+// escape encodes the characters that end or break a workflow command.
+func escape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -6,193 +6,269 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/coscene-io/update-apt-source/locker"
-	"io"
-	"io/ioutil"
+	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coscene-io/update-apt-source/config"
 	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/journal"
+	"github.com/coscene-io/update-apt-source/logging"
 	"github.com/coscene-io/update-apt-source/release"
 	"github.com/coscene-io/update-apt-source/storage"
+	"github.com/ulikunitz/xz"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/clearsign"
 )
 
-var supportedUbuntuDistros = []string{
-	"bionic",
-	"focal",
-	"jammy",
-	"noble",
-}
+const (
+	defaultConcurrency   = 4
+	defaultRetryAttempts = 5
+	defaultRetryBackoff  = time.Second
+	defaultMinAge        = 24 * time.Hour
+)
 
 func main() {
-	cfg := parseConfig()
-	if err := cfg.IsValid(); err != nil {
-		panic(fmt.Sprintf("Invalid config: %v", err))
+	settings, err := parseArgs(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil {
+		err = logging.Setup(settings.get("log_format"), settings.get("log_level"))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
 	}
 
-	fmt.Printf("Initialize storage client... ")
-	storageProvider, err := storage.NewStorageProvider(
-		cfg.StorageType,
-		cfg.Endpoint,
-		cfg.Region,
-		cfg.AccessKeyId,
-		cfg.AccessKeySecret,
-	)
+	err = run(settings)
+	logging.EndGroup()
 	if err != nil {
-		panic(fmt.Sprintf("Initialize storage client failed: %v", err))
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
-	fmt.Printf(" ✓\n")
-	fmt.Printf("  Accessing bucket... ✓\n")
+}
 
-	// ClearBucket(storageProvider, cfg.BucketName, "", "")
+func run(settings *settings) error {
+	if settings.get("command") == commandInit {
+		return initConfig(settings.get("config"))
+	}
 
-	l := locker.NewLocker(storageProvider, cfg.BucketName)
-	err = l.Lock()
+	for _, in := range inputs {
+		if in.secret {
+			logging.AddSecret(settings.get(in.name))
+		}
+	}
+	cfg, err := parseConfig(settings)
 	if err != nil {
-		panic(fmt.Sprintf("Lock bucket failed: %v", err))
+		return fmt.Errorf("invalid config: %v", err)
 	}
-	defer func() {
-		if err := l.Unlock(); err != nil {
-			fmt.Printf("Warning: Unlock failed: %v\n", err)
-		}
-	}()
+	logging.AddSecret(string(cfg.GpgPrivateKey))
 
-	configList := make([]*config.SingleConfig, len(cfg.DebPaths))
-	for i := range cfg.DebPaths {
-		configList[i] = &config.SingleConfig{
-			UbuntuDistro: cfg.UbuntuDistro,
-			DebPath:      cfg.DebPaths[i],
-			Architecture: cfg.Architectures[i],
+	repoFile, source, err := readLocalRepoFile(settings)
+	if err != nil {
+		return fmt.Errorf("load repository config failed: %v", err)
+	}
+	if repoFile != nil {
+		if err := applyRepoFile(&cfg, repoFile, source, settings); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
 		}
 	}
-	for i, c := range configList {
-		if c.UbuntuDistro != "all" {
-			c.Container = "main"
-			fmt.Printf("\nUbuntu Distro: %s\n", c.UbuntuDistro)
-			fmt.Printf("  [%d/%d] Processing package (%s, %s):\n",
-				i+1, len(configList), c.Architecture, c.DebPath)
 
-			fmt.Printf("    Upload deb package...  ")
-			debInfo, err := uploadDebFile(storageProvider, cfg.BucketName, c)
-			if err != nil {
-				panic(fmt.Sprintf("**Upload deb package failed: %v**", err))
-			}
-
-			fmt.Printf("    Update Packages file...  ")
-			packagesContent, err := updatePackages(storageProvider, cfg.BucketName, c, debInfo)
-			if err != nil {
-				panic(fmt.Sprintf("**Update Packages failed: %v**", err))
-			}
-			fmt.Printf("✓\n")
+	// The repository config in the bucket is only read below, but the
+	// settings that configure the storage must be valid before it is used.
+	if err := cfg.CheckSettings(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
 
-			fmt.Printf("    Generate and upload Packages.gz... ")
-			err = generatePackagesGz(storageProvider, cfg.BucketName, packagesContent, c)
-			if err != nil {
-				panic(fmt.Sprintf("**Generate Packages.gz failed: %v**", err))
-			}
-			fmt.Printf("✓\n")
+	storageProvider, err := newStorageProvider(&cfg)
+	if err != nil {
+		return err
+	}
 
-			fmt.Printf("\n    Update Release file... ")
-			releaseContent, err := updateRelease(storageProvider, cfg.BucketName, c, c.UbuntuDistro)
-			if err != nil {
-				panic(fmt.Sprintf("**Update Release failed: %v**", err))
+	// Without a local repository config the one stored in the bucket is
+	// used, so that every publisher shares it.
+	if repoFile == nil && cfg.BucketName != "" {
+		repoFile, source, err = readBucketRepoFile(storageProvider, cfg.BucketName)
+		if err != nil {
+			return fmt.Errorf("load repository config failed: %v", err)
+		}
+		if repoFile != nil {
+			strategy := cfg.SymlinkStrategy
+			if err := applyRepoFile(&cfg, repoFile, source, settings); err != nil {
+				return fmt.Errorf("invalid config: %v", err)
 			}
-			fmt.Printf("✓\n")
-
-			fmt.Printf("\n    Generate signed files... ")
-			err = signReleaseFiles(storageProvider, cfg.BucketName, releaseContent, &cfg.GpgPrivateKey, c.UbuntuDistro)
-			if err != nil {
-				panic(fmt.Sprintf("Sign files failed: %v", err))
+			// The S3 provider stores links with the strategy it was
+			// created with.
+			if cfg.SymlinkStrategy != strategy {
+				if err := cfg.CheckSettings(); err != nil {
+					return fmt.Errorf("invalid config: %v", err)
+				}
+				if storageProvider, err = newStorageProvider(&cfg); err != nil {
+					return err
+				}
 			}
-			fmt.Printf("✓\n")
+		}
+	}
+	if err := resolveArchitectures(&cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	if err := cfg.IsValid(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	if err := checkSigningKeys(&cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
 
-		} else {
-			c.Container = "stable"
-			fmt.Printf("\nUbuntu Distro: %s\n", c.UbuntuDistro)
-			fmt.Printf("  [%d/%d] Processing package (%s, %s):\n",
-				i+1, len(configList), c.Architecture, c.DebPath)
+	// ClearBucket(storageProvider, cfg.BucketName, "", "")
 
-			fmt.Printf("    Upload deb package...  ")
-			debInfo, err := uploadDebFile(storageProvider, cfg.BucketName, c)
-			if err != nil {
-				panic(fmt.Sprintf("**Upload deb package failed: %v**", err))
-			}
+	if cfg.ReadOnly() {
+		switch cfg.Command {
+		case config.CommandList:
+			err = list(storageProvider, &cfg, os.Stdout)
+		case config.CommandVerify:
+			err = verify(storageProvider, &cfg)
+		}
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", cfg.Command, err)
+		}
+		return nil
+	}
 
-			sourceFile := debInfo.Filename
-			for _, d := range supportedUbuntuDistros {
-				c.UbuntuDistro = d
-				linkName := fmt.Sprintf("dists/%s/%s/binary-%s/%s", d, c.Container, c.Architecture, filepath.Base(c.DebPath))
-				fmt.Printf("    Create deb file redirect: %s -> %s\n", linkName, sourceFile)
+	// A dry run records the changes instead of making them, so it neither
+	// takes the lock nor recovers or writes a journal, and sets no outputs.
+	if cfg.DryRun {
+		recorder := storage.NewRecorder(storageProvider)
+		if err := runCommand(recorder, recorder, &cfg, newReport()); err != nil {
+			return fmt.Errorf("%s failed: %v", cfg.Command, err)
+		}
+		if err := printPlan(storageProvider, recorder, cfg.BucketName, os.Stdout); err != nil {
+			return fmt.Errorf("print plan failed: %v", err)
+		}
+		return nil
+	}
 
-				err = storageProvider.CreateSymlink(cfg.BucketName, sourceFile, linkName)
-				if err != nil {
-					fmt.Printf("    Warning: Create redirect failed: %v\n", err)
-				}
+	l := locker.NewLocker(storageProvider, cfg.BucketName)
+	if err := l.Lock(); err != nil {
+		return fmt.Errorf("lock bucket failed: %v", err)
+	}
+	defer func() {
+		if err := l.Unlock(); err != nil {
+			slog.Warn("unlock failed", "error", err)
+		}
+	}()
 
-				debInfo.Filename = linkName
+	j := journal.NewJournal(storageProvider, cfg.BucketName)
+	if err := j.Recover(); err != nil {
+		return fmt.Errorf("recover unfinished publish failed: %v", err)
+	}
 
-				fmt.Printf("    Update Packages file...  ")
-				packagesContent, err := updatePackages(storageProvider, cfg.BucketName, c, debInfo)
-				if err != nil {
-					panic(fmt.Sprintf("**Update Packages failed: %v**", err))
-				}
-				fmt.Printf("✓\n")
+	rep := newReport()
+	if err := runCommand(j, storageProvider, &cfg, rep); err != nil {
+		slog.Warn("rolling back repository changes", "command", cfg.Command, "error", err)
+		if rollbackErr := j.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%s failed: %v; rollback failed, it will be retried by the next run: %v", cfg.Command, err, rollbackErr)
+		}
+		return fmt.Errorf("%s failed, repository restored: %v", cfg.Command, err)
+	}
 
-				fmt.Printf("    Generate and upload Packages.gz... ")
-				err = generatePackagesGz(storageProvider, cfg.BucketName, packagesContent, c)
-				if err != nil {
-					panic(fmt.Sprintf("**Generate Packages.gz failed: %v**", err))
-				}
-				fmt.Printf("✓\n")
+	if err := j.Commit(); err != nil {
+		return fmt.Errorf("commit journal failed: %v", err)
+	}
+	if err := writeActionOutputs(&cfg, rep); err != nil {
+		return fmt.Errorf("%s succeeded, but %v", cfg.Command, err)
+	}
 
-				fmt.Printf("    Update Release file... ")
-				releaseContent, err := updateRelease(storageProvider, cfg.BucketName, c, d)
-				if err != nil {
-					panic(fmt.Sprintf("**Update Release failed: %v**", err))
-				}
-				fmt.Printf("✓\n")
+	slog.Info("all operations completed successfully", "command", cfg.Command)
+	return nil
+}
 
-				fmt.Printf("    Generate signed files... ")
-				err = signReleaseFiles(storageProvider, cfg.BucketName, releaseContent, &cfg.GpgPrivateKey, d)
-				if err != nil {
-					panic(fmt.Sprintf("Sign files failed: %v", err))
-				}
-				fmt.Printf("✓\n\n")
+// runCommand runs a command that changes the repository. Its changes go
+// through journaled, except for those of gc, which go to direct, and what it
+// published is added to rep.
+func runCommand(journaled, direct storage.StorageProvider, cfg *config.Config, rep *report) error {
+	switch cfg.Command {
+	case config.CommandMigrate:
+		return migrateToPool(journaled, cfg, rep)
+	case config.CommandPromote:
+		return promote(journaled, cfg, rep)
+	case config.CommandRemove:
+		return remove(journaled, cfg, rep)
+	case config.CommandRebuild:
+		return rebuild(journaled, cfg, rep)
+	case config.CommandGC:
+		// Deletions of unreferenced files are not journaled, as backing up
+		// every deleted package would double the storage gc is reclaiming.
+		return gc(direct, cfg)
+	case config.CommandSnapshot:
+		return snapshot(journaled, cfg)
+	case config.CommandRollback:
+		return rollback(journaled, cfg, rep)
+	default:
+		configList := make([]*config.SingleConfig, len(cfg.DebPaths))
+		for i := range cfg.DebPaths {
+			configList[i] = &config.SingleConfig{
+				UbuntuDistro: cfg.UbuntuDistro,
+				DebPath:      cfg.DebPaths[i],
+				Architecture: cfg.Architectures[i],
+				Container:    cfg.ComponentFor(cfg.UbuntuDistro),
+				Layout:       cfg.Layout,
 			}
 		}
+		return publish(journaled, cfg, configList, rep)
 	}
-
-	fmt.Println("\nAll operations completed successfully! 🎉")
 }
 
-func parseConfig() config.Config {
-	debPathsStr := os.Getenv("INPUT_DEB_PATHS")
-	architecturesStr := os.Getenv("INPUT_ARCHITECTURES")
-	distroStr := os.Getenv("INPUT_UBUNTU_DISTRO")
-	endpointStr := os.Getenv("INPUT_ENDPOINT")
-	bucketStr := os.Getenv("INPUT_BUCKET_NAME")
-	regionStr := os.Getenv("INPUT_REGION")
-	storageTypeStr := os.Getenv("INPUT_STORAGE_TYPE")
-
-	fmt.Println("🌍Environment variables:")
-	fmt.Println("    INPUT_DEB_PATHS:", debPathsStr)
-	fmt.Println("    INPUT_ARCHITECTURES:", architecturesStr)
-	fmt.Println("    INPUT_UBUNTU_DISTRO:", distroStr)
-	fmt.Println("    INPUT_ENDPOINT:", endpointStr)
-	fmt.Println("    INPUT_BUCKET_NAME:", bucketStr)
-	fmt.Println("    INPUT_REGION:", regionStr)
-	fmt.Println("    INPUT_STORAGE_TYPE:", storageTypeStr)
-	fmt.Println("")
+func parseConfig(settings *settings) (config.Config, error) {
+	commandStr := settings.get("command")
+	debPathsStr := settings.get("deb_paths")
+	architecturesStr := settings.get("architectures")
+	distroStr := settings.get("ubuntu_distro")
+	componentStr := settings.get("component")
+	packageNameStr := settings.get("package_name")
+	packageVersionStr := settings.get("package_version")
+	sourceDistroStr := settings.get("source_distro")
+	sourceComponentStr := settings.get("source_component")
+	filterStr := settings.get("filter")
+	deleteDebsStr := settings.get("delete_debs")
+	formatStr := settings.get("format")
+	minAgeStr := settings.get("min_age")
+	dryRunStr := settings.get("dry_run")
+	snapshotNameStr := settings.get("snapshot_name")
+	endpointStr := settings.get("endpoint")
+	bucketStr := settings.get("bucket_name")
+	regionStr := settings.get("region")
+	storageTypeStr := settings.get("storage_type")
+	fullReleaseStr := settings.get("full_release")
+	concurrencyStr := settings.get("concurrency")
+	retryAttemptsStr := settings.get("retry_attempts")
+	retryBackoffStr := settings.get("retry_backoff")
+	symlinkStrategyStr := settings.get("symlink_strategy")
+	layoutStr := settings.get("layout")
+	distributionsStr := settings.get("distributions")
+	allDistributionsStr := settings.get("all_distributions")
+	suitesStr := settings.get("suites")
+
+	attrs := []any{"command", commandStr}
+	for _, in := range inputs {
+		if !in.secret {
+			attrs = append(attrs, in.name, settings.get(in.name))
+		}
+	}
+	slog.Debug("settings", attrs...)
 
 	var debPaths, architectures []string
 
@@ -200,27 +276,119 @@ func parseConfig() config.Config {
 
 	architectures = parseMultilineOrCommaInput(architecturesStr)
 
-	if len(debPaths) != len(architectures) {
-		panic("deb_paths and architectures must have the same number of elements")
+	privateKey, err := readKey(settings, "gpg_private_key")
+	if err != nil {
+		return config.Config{}, fmt.Errorf("read GPG private key failed: %v", err)
 	}
 
-	privateKey, err := base64.StdEncoding.DecodeString(os.Getenv("INPUT_GPG_PRIVATE_KEY"))
+	publicKey, err := readKey(settings, "gpg_public_key")
 	if err != nil {
-		panic("Failed to decode GPG private key: " + err.Error())
+		return config.Config{}, fmt.Errorf("read GPG public key failed: %v", err)
+	}
+
+	concurrency := defaultConcurrency
+	if concurrencyStr != "" {
+		concurrency, err = strconv.Atoi(concurrencyStr)
+		if err != nil {
+			return config.Config{}, fmt.Errorf("parse concurrency failed: %v", err)
+		}
+	}
+
+	retryAttempts := defaultRetryAttempts
+	if retryAttemptsStr != "" {
+		retryAttempts, err = strconv.Atoi(retryAttemptsStr)
+		if err != nil {
+			return config.Config{}, fmt.Errorf("parse retry attempts failed: %v", err)
+		}
+	}
+
+	retryBackoff := defaultRetryBackoff
+	if retryBackoffStr != "" {
+		retryBackoff, err = time.ParseDuration(retryBackoffStr)
+		if err != nil {
+			return config.Config{}, fmt.Errorf("parse retry backoff failed: %v", err)
+		}
+	}
+
+	minAge := defaultMinAge
+	if minAgeStr != "" {
+		minAge, err = time.ParseDuration(minAgeStr)
+		if err != nil {
+			return config.Config{}, fmt.Errorf("parse min age failed: %v", err)
+		}
+	}
+
+	repo := config.DefaultRepoConfig()
+	if distributionsStr != "" {
+		repo.Distributions = parseMultilineOrCommaInput(distributionsStr)
+		repo.AllDistributions = repo.Distributions
+	}
+	if allDistributionsStr != "" {
+		repo.AllDistributions = parseMultilineOrCommaInput(allDistributionsStr)
+	}
+	if suitesStr != "" {
+		repo.Suites = make(map[string]string)
+		for _, mapping := range parseMultilineOrCommaInput(suitesStr) {
+			suite, codename, ok := strings.Cut(mapping, "=")
+			if !ok {
+				return config.Config{}, fmt.Errorf("parse suites failed: expected suite=codename, got %s", mapping)
+			}
+			repo.Suites[strings.TrimSpace(suite)] = strings.TrimSpace(codename)
+		}
+	}
+
+	if commandStr == "" {
+		commandStr = config.CommandPublish
+	}
+	if layoutStr == "" {
+		layoutStr = config.LayoutDists
+	}
+	if formatStr == "" {
+		formatStr = config.FormatTable
 	}
 
 	return config.Config{
+		Repo:            repo,
+		Command:         commandStr,
 		UbuntuDistro:    distroStr,
+		Component:       componentStr,
+		PackageName:     packageNameStr,
+		PackageVersion:  packageVersionStr,
+		SourceDistro:    sourceDistroStr,
+		SourceComponent: sourceComponentStr,
+		Filter:          filterStr,
+		DeleteDebs:      strings.EqualFold(deleteDebsStr, "true"),
+		Format:          formatStr,
+		MinAge:          minAge,
+		DryRun:          strings.EqualFold(dryRunStr, "true"),
+		SnapshotName:    snapshotNameStr,
 		DebPaths:        debPaths,
 		Architectures:   architectures,
 		StorageType:     storageTypeStr,
 		Endpoint:        endpointStr,
 		Region:          regionStr,
 		BucketName:      bucketStr,
-		AccessKeyId:     os.Getenv("INPUT_ACCESS_KEY_ID"),
-		AccessKeySecret: os.Getenv("INPUT_ACCESS_KEY_SECRET"),
+		BaseURL:         settings.get("base_url"),
+		AccessKeyId:     settings.get("access_key_id"),
+		AccessKeySecret: settings.get("access_key_secret"),
 		GpgPrivateKey:   privateKey,
+		GpgPublicKey:    publicKey,
+		FullRelease:     strings.EqualFold(fullReleaseStr, "true"),
+		Concurrency:     concurrency,
+		RetryAttempts:   retryAttempts,
+		RetryBackoff:    retryBackoff,
+		SymlinkStrategy: symlinkStrategyStr,
+		Layout:          layoutStr,
+	}, nil
+}
+
+// readKey returns the armored GPG key in the <name>_file setting, or else
+// the base64 encoded one in <name>.
+func readKey(settings *settings, name string) ([]byte, error) {
+	if path := settings.get(name + "_file"); path != "" {
+		return os.ReadFile(path)
 	}
+	return base64.StdEncoding.DecodeString(settings.get(name))
 }
 
 func parseMultilineOrCommaInput(input string) []string {
@@ -244,45 +412,26 @@ func parseMultilineOrCommaInput(input string) []string {
 	return result
 }
 
-func uploadDebFile(storageProvider storage.StorageProvider, bucketName string, cfg *config.SingleConfig) (*deb.DebFileInfo, error) {
-	file, err := os.Open(cfg.DebPath)
-	if err != nil {
-		return nil, fmt.Errorf("open file failed: %v", err)
-	}
-	defer file.Close()
-
-	md5hash := md5.New()
-	sha1hash := sha1.New()
-	sha256hash := sha256.New()
-	size, err := io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), file)
+func uploadDebFile(storageProvider storage.StorageProvider, bucketName string, cfg *config.SingleConfig, log *slog.Logger) (*deb.DebFileInfo, error) {
+	fileContent, err := os.ReadFile(cfg.DebPath)
 	if err != nil {
-		return nil, fmt.Errorf("calculate checksum failed: %v", err)
-	}
-
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("reset file pointer failed: %v", err)
+		return nil, fmt.Errorf("read file failed: %v", err)
 	}
 
-	debInfo, err := deb.GetInfoFromDebFile(file)
+	debInfo, err := readDebInfo(fileContent)
 	if err != nil {
-		return nil, fmt.Errorf("get deb info failed: %v", err)
+		return nil, err
 	}
 
 	baseFilename := filepath.Base(cfg.DebPath)
-	debInfo.Filename = fmt.Sprintf("dists/%s/%s/binary-%s/%s",
-		cfg.UbuntuDistro,
-		cfg.Container,
-		cfg.Architecture,
-		baseFilename)
-
-	debInfo.Size = size
-	debInfo.MD5sum = hex.EncodeToString(md5hash.Sum(nil))
-	debInfo.SHA1 = hex.EncodeToString(sha1hash.Sum(nil))
-	debInfo.SHA256 = hex.EncodeToString(sha256hash.Sum(nil))
-
-	fileContent, err := ioutil.ReadFile(cfg.DebPath)
-	if err != nil {
-		return nil, fmt.Errorf("read file failed: %v", err)
+	if cfg.Layout == config.LayoutPool {
+		debInfo.Filename = poolPath(cfg.Container, debInfo, baseFilename)
+	} else {
+		debInfo.Filename = fmt.Sprintf("dists/%s/%s/binary-%s/%s",
+			cfg.UbuntuDistro,
+			cfg.Container,
+			cfg.Architecture,
+			baseFilename)
 	}
 
 	err = storageProvider.PutObject(bucketName, debInfo.Filename, fileContent)
@@ -290,112 +439,179 @@ func uploadDebFile(storageProvider storage.StorageProvider, bucketName string, c
 		return nil, fmt.Errorf("upload to cloud storage failed: %v", err)
 	}
 
-	fmt.Printf("✓\n")
-	parts := strings.Split(baseFilename, "_")
-	if len(parts) >= 3 {
-		packageName := parts[0]
-		architecture := parts[len(parts)-1]
-
-		latestFilename := fmt.Sprintf("%s_latest_%s", packageName, architecture)
-		latestS3Path := fmt.Sprintf("dists/%s/%s/binary-%s/%s",
-			cfg.UbuntuDistro,
-			cfg.Container,
-			cfg.Architecture,
-			latestFilename)
-
-		fmt.Printf("    Create redirect %s -> %s ...  ", latestFilename, baseFilename)
+	log.Info("uploaded deb package", "key", debInfo.Filename)
+	if latestS3Path, ok := latestAliasKey(debInfo.Filename); ok {
+		log.Info("creating redirect", "key", latestS3Path, "target", debInfo.Filename)
 		err = storageProvider.CreateSymlink(bucketName, debInfo.Filename, latestS3Path)
 		if err != nil {
-			fmt.Printf("    Warning: Create redirect failed: %v\n", err)
+			log.Warn("create redirect failed", "key", latestS3Path, "error", err)
 		}
-		fmt.Printf("✓\n")
 	} else {
-		fmt.Printf("    Warning: File name format does not match link creation: %s\n", baseFilename)
+		log.Warn("file name format does not match link creation", "file", baseFilename)
 	}
 
 	return debInfo, nil
 }
 
-func updatePackages(storageProvider storage.StorageProvider, bucketName string, cfg *config.SingleConfig, newDeb *deb.DebFileInfo) (string, error) {
-	prefix := fmt.Sprintf("dists/%s/%s/binary-%s", cfg.UbuntuDistro, cfg.Container, cfg.Architecture)
-	packagesPath := fmt.Sprintf("%s/Packages", prefix)
+// newStorageProvider creates the storage client of cfg, with retries.
+func newStorageProvider(cfg *config.Config) (storage.StorageProvider, error) {
+	storageProvider, err := storage.NewStorageProvider(
+		cfg.StorageType,
+		cfg.Endpoint,
+		cfg.Region,
+		cfg.AccessKeyId,
+		cfg.AccessKeySecret,
+		cfg.SymlinkStrategy,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("initialize storage client failed: %v", err)
+	}
+	slog.Info("initialized storage client", "storage_type", cfg.StorageType, "bucket", cfg.BucketName, "symlink_strategy", cfg.SymlinkStrategy)
+	return storage.NewRetryProvider(storageProvider, cfg.RetryAttempts, cfg.RetryBackoff), nil
+}
 
-	packages := make(map[string]*deb.DebFileInfo)
+// latestAliasKey returns the key of the <pkg>_latest_<arch>.deb alias that
+// publish creates next to a package file named <pkg>_<version>_<arch>.deb.
+func latestAliasKey(filename string) (string, bool) {
+	parts := strings.Split(path.Base(filename), "_")
+	if len(parts) < 3 {
+		return "", false
+	}
+	return path.Join(path.Dir(filename), fmt.Sprintf("%s_latest_%s", parts[0], parts[len(parts)-1])), true
+}
 
-	exists, err := storageProvider.HeadObject(bucketName, packagesPath)
+// readDebInfo parses the control file of a package and computes the size
+// and checksums that its Packages entry lists.
+func readDebInfo(content []byte) (*deb.DebFileInfo, error) {
+	debInfo, err := deb.GetInfoFromDebFile(bytes.NewReader(content))
 	if err != nil {
-		return "", fmt.Errorf("get Packages file failed: %v", err)
+		return nil, fmt.Errorf("get deb info failed: %v", err)
 	}
-	if exists {
-		packagesContent, err := storageProvider.GetObject(bucketName, packagesPath)
-		if err != nil {
-			return "", fmt.Errorf("get Packages file failed: %v", err)
-		}
-		packages = deb.ParsePackagesFile(bytes.NewReader(packagesContent))
+	if debInfo.Name == "" {
+		return nil, fmt.Errorf("get deb info failed: control file has no Package field")
 	}
 
-	packages[newDeb.Name] = newDeb
+	md5sum := md5.Sum(content)
+	sha1sum := sha1.Sum(content)
+	sha256sum := sha256.Sum256(content)
+	debInfo.Size = int64(len(content))
+	debInfo.MD5sum = hex.EncodeToString(md5sum[:])
+	debInfo.SHA1 = hex.EncodeToString(sha1sum[:])
+	debInfo.SHA256 = hex.EncodeToString(sha256sum[:])
+	return debInfo, nil
+}
 
-	if err := os.MkdirAll(prefix, 0755); err != nil {
-		return "", fmt.Errorf("create directory failed: %v", err)
+// resolveArchitectures takes the architecture of each package to publish
+// from the Architecture field of its control file, or, when architectures
+// are given, checks them against it. A package of architecture all may be
+// published to any architecture.
+func resolveArchitectures(cfg *config.Config) error {
+	// IsValid reports a different number of architectures and packages.
+	if cfg.Command != config.CommandPublish || (len(cfg.Architectures) > 0 && len(cfg.Architectures) != len(cfg.DebPaths)) {
+		return nil
 	}
 
-	var content strings.Builder
-	for _, pkg := range packages {
-		content.WriteString(pkg.Format())
+	architectures := make([]string, len(cfg.DebPaths))
+	for i, debPath := range cfg.DebPaths {
+		arch, err := readDebArchitecture(debPath)
+		if err != nil {
+			return fmt.Errorf("read architecture of %s failed: %v", debPath, err)
+		}
+		if len(cfg.Architectures) == 0 {
+			architectures[i] = arch
+			continue
+		}
+		if given := cfg.Architectures[i]; given != arch && arch != "all" {
+			return fmt.Errorf("%s is a package for architecture %s, but architectures gives %s", debPath, arch, given)
+		}
+		architectures[i] = cfg.Architectures[i]
 	}
+	cfg.Architectures = architectures
+	return nil
+}
 
-	contentStr := content.String()
-
-	if err := os.WriteFile(packagesPath, []byte(contentStr), 0644); err != nil {
-		return "", fmt.Errorf("write local Packages file failed: %v", err)
+// readDebArchitecture returns the Architecture field of the control file of
+// a package.
+func readDebArchitecture(debPath string) (string, error) {
+	f, err := os.Open(debPath)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	err = storageProvider.PutObject(bucketName, packagesPath, []byte(contentStr))
+	debInfo, err := deb.GetInfoFromDebFile(f)
 	if err != nil {
-		return "", fmt.Errorf("upload Packages file failed: %v", err)
+		return "", err
 	}
-
-	return contentStr, nil
+	if debInfo.Architecture == "" {
+		return "", fmt.Errorf("control file has no Architecture field")
+	}
+	return debInfo.Architecture, nil
 }
 
-func generatePackagesGz(storageProvider storage.StorageProvider, bucketName string, content string, cfg *config.SingleConfig) error {
-	localDir := fmt.Sprintf("dists/%s/%s/binary-%s", cfg.UbuntuDistro, cfg.Container, cfg.Architecture)
-	localPackagesGzPath := filepath.Join(localDir, "Packages.gz")
+func updatePackages(storageProvider storage.StorageProvider, bucketName string, key indexKey, newDebs []*deb.DebFileInfo) (string, error) {
+	packagesPath := fmt.Sprintf("dists/%s/%s/Packages", key.Distro, key.Path())
 
-	gzFile, err := os.Create(localPackagesGzPath)
-	if err != nil {
-		return fmt.Errorf("create Packages.gz file failed: %v", err)
+	packages := make(map[string]*deb.DebFileInfo)
+
+	packagesContent, err := storageProvider.GetObject(bucketName, packagesPath)
+	if err == nil {
+		packages = deb.ParsePackagesFile(bytes.NewReader(packagesContent))
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return "", fmt.Errorf("get Packages file failed: %v", err)
 	}
-	defer gzFile.Close()
 
-	gz := gzip.NewWriter(gzFile)
-	if _, err := gz.Write([]byte(content)); err != nil {
-		return fmt.Errorf("write gzip content failed: %v", err)
+	for _, newDeb := range newDebs {
+		packages[newDeb.Name] = newDeb
 	}
-	if err := gz.Close(); err != nil {
-		return fmt.Errorf("close gzip writer failed: %v", err)
+
+	return formatPackages(packages), nil
+}
+
+func formatPackages(packages map[string]*deb.DebFileInfo) string {
+	var content strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(packages)) {
+		content.WriteString(packages[name].Format())
 	}
+	return content.String()
+}
 
-	gzContent, err := ioutil.ReadFile(localPackagesGzPath)
+func generatePackagesXz(content string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
 	if err != nil {
-		return fmt.Errorf("read Packages.gz file failed: %v", err)
+		return nil, fmt.Errorf("create xz writer failed: %v", err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		return nil, fmt.Errorf("write xz content failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("close xz writer failed: %v", err)
 	}
 
-	packagesGzPath := fmt.Sprintf("dists/%s/%s/binary-%s/Packages.gz",
-		cfg.UbuntuDistro,
-		cfg.Container,
-		cfg.Architecture)
+	return buf.Bytes(), nil
+}
 
-	err = storageProvider.PutObject(bucketName, packagesGzPath, gzContent)
-	if err != nil {
-		return fmt.Errorf("upload Packages.gz file failed: %v", err)
+func generatePackagesGz(content string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		return nil, fmt.Errorf("write gzip content failed: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("close gzip writer failed: %v", err)
 	}
 
-	return nil
+	return buf.Bytes(), nil
 }
 
-func updateRelease(storageProvider storage.StorageProvider, bucketName string, cfg *config.SingleConfig, distro string) (string, error) {
+// updateRelease merges the given index files, keyed by their path relative
+// to dists/<distro>/, into the distro's current Release file. With full set,
+// the existing checksum entries are discarded and every other index file
+// found under dists/<distro>/ in the bucket is rehashed instead. The Suite
+// field is set to the suite that points at the distro, or to the distro when
+// it is not part of a suite, and the other fields are taken from repo.
+func updateRelease(storageProvider storage.StorageProvider, bucketName string, distro string, repo *config.RepoConfig, indexes map[string][]byte, full bool) (string, error) {
 	prefix := fmt.Sprintf("dists/%s/", distro)
 	releasePath := fmt.Sprintf("%sRelease", prefix)
 
@@ -412,196 +628,125 @@ func updateRelease(storageProvider storage.StorageProvider, bucketName string, c
 		SHA512:      make(map[string]*release.PackageInfo),
 	}
 
-	exists, err := storageProvider.HeadObject(bucketName, releasePath)
-	if err != nil {
+	releaseContent, err := storageProvider.GetObject(bucketName, releasePath)
+	if err == nil {
+		releaseFile = release.ParseReleaseFile(bytes.NewReader(releaseContent))
+	} else if !errors.Is(err, storage.ErrNotFound) {
 		return "", fmt.Errorf("get Release file failed: %v", err)
 	}
-	if exists {
-		releaseContent, err := storageProvider.GetObject(bucketName, releasePath)
-		if err != nil {
-			return "", fmt.Errorf("get Release file failed: %v", err)
-		}
-		releaseFile = release.ParseReleaseFile(bytes.NewReader(releaseContent))
+
+	releaseFile.Origin = repo.Origin
+	releaseFile.Label = repo.Label
+	releaseFile.Description = repo.Description
+	releaseFile.Codename = distro
+	releaseFile.Suite = distro
+	if suite := repo.SuiteFor(distro); suite != "" {
+		releaseFile.Suite = suite
 	}
 
-	pkgKey := fmt.Sprintf("%s/binary-%s/Packages", cfg.Container, cfg.Architecture)
-	pkgPath := fmt.Sprintf("dists/%s/%s", distro, pkgKey)
-	md5Str, sha1Str, sha256Str, sha512Str, length, err := calculateFileHashes(pkgPath)
-	if err == nil {
-		releaseFile.MD5Sum[pkgKey] = &release.PackageInfo{
-			Sum:  md5Str,
-			Size: length,
-			Path: pkgKey,
-		}
-		releaseFile.SHA1[pkgKey] = &release.PackageInfo{
-			Sum:  sha1Str,
-			Size: length,
-			Path: pkgKey,
-		}
-		releaseFile.SHA256[pkgKey] = &release.PackageInfo{
-			Sum:  sha256Str,
-			Size: length,
-			Path: pkgKey,
+	if full {
+		releaseFile.ClearFiles()
+
+		objects, err := storageProvider.ListObjects(bucketName, prefix)
+		if err != nil {
+			return "", fmt.Errorf("list index files failed: %v", err)
 		}
-		releaseFile.SHA512[pkgKey] = &release.PackageInfo{
-			Sum:  sha512Str,
-			Size: length,
-			Path: pkgKey,
+		for _, obj := range objects {
+			path := strings.TrimPrefix(obj.Key, prefix)
+			if !release.IsIndexFile(path) {
+				continue
+			}
+			if _, ok := indexes[path]; ok {
+				continue
+			}
+			content, err := storageProvider.GetObject(bucketName, obj.Key)
+			if err != nil {
+				return "", fmt.Errorf("get index file %s failed: %v", obj.Key, err)
+			}
+			releaseFile.SetFile(path, content)
 		}
 	}
 
-	gzKey := fmt.Sprintf("%s/binary-%s/Packages.gz", cfg.Container, cfg.Architecture)
-	gzPath := fmt.Sprintf("dists/%s/%s", distro, gzKey)
-	md5Str, sha1Str, sha256Str, sha512Str, length, err = calculateFileHashes(gzPath)
-	if err == nil {
-		releaseFile.MD5Sum[gzKey] = &release.PackageInfo{
-			Sum:  md5Str,
-			Size: length,
-			Path: gzKey,
-		}
-		releaseFile.SHA1[gzKey] = &release.PackageInfo{
-			Sum:  sha1Str,
-			Size: length,
-			Path: gzKey,
-		}
-		releaseFile.SHA256[gzKey] = &release.PackageInfo{
-			Sum:  sha256Str,
-			Size: length,
-			Path: gzKey,
-		}
-		releaseFile.SHA512[gzKey] = &release.PackageInfo{
-			Sum:  sha512Str,
-			Size: length,
-			Path: gzKey,
+	for path, content := range indexes {
+		releaseFile.SetFile(path, content)
+	}
+	// Drop the variants of updated Packages files in compressions that are
+	// no longer configured, so apt never fetches a stale one.
+	for p := range releaseFile.SHA256 {
+		dir, name := path.Split(p)
+		if _, ok := indexes[dir+"Packages"]; ok && strings.HasPrefix(name, "Packages.") && indexes[p] == nil {
+			releaseFile.RemoveFile(p)
 		}
 	}
+	releaseFile.UpdateComponents()
 
 	currentTime := time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 -0700")
 	releaseFile.Date = currentTime
 
-	releaseString := releaseFile.ToString()
-
-	localReleasePath := fmt.Sprintf("dists/%s/Release", distro)
-	if err := os.MkdirAll(fmt.Sprintf("dists/%s", distro), 0755); err != nil {
-		return "", fmt.Errorf("create directory failed: %v", err)
-	}
+	return releaseFile.ToString(), nil
+}
 
-	if err := os.WriteFile(localReleasePath, []byte(releaseString), 0644); err != nil {
-		return "", fmt.Errorf("write local Release file failed: %v", err)
+// checkSigningKeys checks that the keys of the run are the one the
+// repository config pins, if it pins one.
+func checkSigningKeys(cfg *config.Config) error {
+	fingerprint := config.NormalizeFingerprint(cfg.Repo.Signing.Fingerprint)
+	if fingerprint == "" {
+		return nil
 	}
 
-	err = storageProvider.PutObject(bucketName, releasePath, []byte(releaseString))
-	if err != nil {
-		return "", fmt.Errorf("upload Release file failed: %v", err)
+	keys := map[string][]byte{"gpg public key": cfg.GpgPublicKey}
+	if !cfg.ReadOnly() {
+		keys["gpg private key"] = cfg.GpgPrivateKey
 	}
-
-	return releaseString, nil
-}
-
-func calculateFileHashes(filepath string) (md5sum, sha1sum, sha256sum, sha512sum string, size int, err error) {
-	content, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return "", "", "", "", 0, err
+	for name, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		if err != nil {
+			return fmt.Errorf("read %s failed: %v", name, err)
+		}
+		actual := strings.ToUpper(hex.EncodeToString(keyring[0].PrimaryKey.Fingerprint[:]))
+		if actual != fingerprint {
+			return fmt.Errorf("%s has fingerprint %s, but the repository is signed by %s", name, actual, fingerprint)
+		}
 	}
-
-	md5hash := md5.Sum(content)
-	sha1hash := sha1.Sum(content)
-	sha256hash := sha256.Sum256(content)
-	sha512hash := sha512.Sum512(content)
-
-	return hex.EncodeToString(md5hash[:]),
-		hex.EncodeToString(sha1hash[:]),
-		hex.EncodeToString(sha256hash[:]),
-		hex.EncodeToString(sha512hash[:]),
-		len(content),
-		nil
+	return nil
 }
 
-func signReleaseFiles(storageProvider storage.StorageProvider, bucketName string, releaseContent string, privateKey *[]byte, distro string) error {
+func signReleaseFiles(releaseContent string, privateKey *[]byte) (releaseGpg, inRelease []byte, err error) {
 	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(*privateKey))
 	if err != nil {
-		return fmt.Errorf("read GPG key failed: %v", err)
+		return nil, nil, fmt.Errorf("read GPG key failed: %v", err)
 	}
 
 	var gpgBuf bytes.Buffer
 	w, err := armor.Encode(&gpgBuf, openpgp.SignatureType, nil)
 	if err != nil {
-		return fmt.Errorf("create signature encoder failed: %v", err)
+		return nil, nil, fmt.Errorf("create signature encoder failed: %v", err)
 	}
 
 	err = openpgp.DetachSign(w, keyring[0], strings.NewReader(releaseContent), nil)
 	if err != nil {
-		return fmt.Errorf("generate detached signature failed: %v", err)
+		return nil, nil, fmt.Errorf("generate detached signature failed: %v", err)
 	}
 	w.Close()
 
-	releasePath := fmt.Sprintf("dists/%s/Release.gpg", distro)
-
-	err = storageProvider.PutObject(bucketName, releasePath, gpgBuf.Bytes())
-	if err != nil {
-		return fmt.Errorf("upload Release.gpg file failed: %v", err)
-	}
-
 	var inReleaseBuf bytes.Buffer
 	w2, err := clearsign.Encode(&inReleaseBuf, keyring[0].PrivateKey, nil)
 	if err != nil {
-		return fmt.Errorf("create plaintext signature encoder failed: %v", err)
+		return nil, nil, fmt.Errorf("create plaintext signature encoder failed: %v", err)
 	}
 
 	_, err = w2.Write([]byte(releaseContent))
 	if err != nil {
-		return fmt.Errorf("write plaintext signature content failed: %v", err)
+		return nil, nil, fmt.Errorf("write plaintext signature content failed: %v", err)
 	}
 
 	err = w2.Close()
 	if err != nil {
-		return fmt.Errorf("close plaintext signature encoder failed: %v", err)
-	}
-
-	inReleasePath := fmt.Sprintf("dists/%s/InRelease", distro)
-
-	err = storageProvider.PutObject(bucketName, inReleasePath, inReleaseBuf.Bytes())
-	if err != nil {
-		return fmt.Errorf("upload InRelease file failed: %v", err)
-	}
-	return nil
-}
-
-func PrintDirectoryTree(root string, indent string) error {
-	entries, err := os.ReadDir(root)
-	if err != nil {
-		return fmt.Errorf("read directory %s failed: %v", root, err)
+		return nil, nil, fmt.Errorf("close plaintext signature encoder failed: %v", err)
 	}
 
-	for i, entry := range entries {
-		isLast := i == len(entries)-1
-
-		connector := "├── "
-		if isLast {
-			connector = "└── "
-		}
-
-		info, err := entry.Info()
-		size := ""
-		if err == nil {
-			size = fmt.Sprintf("(%d bytes)", info.Size())
-		}
-
-		fmt.Printf("%s%s%s %s\n", indent, connector, entry.Name(), size)
-
-		if entry.IsDir() {
-			newIndent := indent + "│   "
-			if isLast {
-				newIndent = indent + "    "
-			}
-
-			subdir := filepath.Join(root, entry.Name())
-			err := PrintDirectoryTree(subdir, newIndent)
-			if err != nil {
-				fmt.Printf("%s    [Error: %v]\n", newIndent, err)
-			}
-		}
-	}
-
-	return nil
+	return gpgBuf.Bytes(), inReleaseBuf.Bytes(), nil
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/coscene-io/update-apt-source/config"
+)
+
+// reportedPackage is a Packages entry written by a run.
+type reportedPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Distro       string `json:"distro"`
+	Component    string `json:"component"`
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+}
+
+// report collects what a run changed in the repository, for the outputs
+// and the job summary of the action.
+type report struct {
+	mu       sync.Mutex
+	packages []reportedPackage
+	distros  []string
+}
+
+func newReport() *report {
+	return &report{}
+}
+
+// addPackages records the packages of a batch as published.
+func (r *report) addPackages(batch *publishBatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, distro := range batch.distros {
+		for _, key := range batch.indexes[distro] {
+			for _, debInfo := range batch.packages[key] {
+				r.packages = append(r.packages, reportedPackage{
+					Name:         debInfo.Name,
+					Version:      debInfo.Version,
+					Architecture: debInfo.Architecture,
+					Distro:       key.Distro,
+					Component:    key.Component,
+					Key:          debInfo.Filename,
+				})
+			}
+		}
+	}
+}
+
+// addDistro records a distro whose indexes and Release files were rewritten.
+func (r *report) addDistro(distro string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !slices.Contains(r.distros, distro) {
+		r.distros = append(r.distros, distro)
+	}
+}
+
+// repositoryURL returns the public URL of the repository root: base_url if
+// it is set, or else the virtual-hosted style URL of the bucket at the
+// storage endpoint.
+func repositoryURL(cfg *config.Config) string {
+	if cfg.BaseURL != "" {
+		return strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	endpoint := cfg.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s.%s", u.Scheme, cfg.BucketName, u.Host)
+}
+
+// writeActionOutputs writes the outputs of the action to $GITHUB_OUTPUT and
+// a Markdown summary of the run to $GITHUB_STEP_SUMMARY, each only when the
+// runner sets it.
+func writeActionOutputs(cfg *config.Config, r *report) error {
+	base := repositoryURL(cfg)
+	packages := slices.Clone(r.packages)
+	for i := range packages {
+		packages[i].URL = base + "/" + packages[i].Key
+	}
+
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		outputs, err := formatOutputs(base, packages, r.distros)
+		if err != nil {
+			return fmt.Errorf("format outputs failed: %v", err)
+		}
+		if err := appendFile(path, outputs); err != nil {
+			return fmt.Errorf("write outputs failed: %v", err)
+		}
+	}
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		if err := appendFile(path, formatSummary(cfg, base, packages, r.distros)); err != nil {
+			return fmt.Errorf("write job summary failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// formatOutputs formats the outputs as name=value lines. Lists are joined
+// by commas, as list inputs are, and packages is a JSON array of every
+// published entry.
+func formatOutputs(base string, packages []reportedPackage, distros []string) (string, error) {
+	var names, versions, keys, urls []string
+	for _, pkg := range packages {
+		if !slices.Contains(names, pkg.Name) {
+			names = append(names, pkg.Name)
+		}
+		if version := pkg.Name + "=" + pkg.Version; !slices.Contains(versions, version) {
+			versions = append(versions, version)
+		}
+		if !slices.Contains(keys, pkg.Key) {
+			keys = append(keys, pkg.Key)
+			urls = append(urls, pkg.URL)
+		}
+	}
+	if packages == nil {
+		packages = []reportedPackage{}
+	}
+	packagesJSON, err := json.Marshal(packages)
+	if err != nil {
+		return "", err
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "repository_url=%s\n", base)
+	fmt.Fprintf(&content, "packages=%s\n", packagesJSON)
+	fmt.Fprintf(&content, "package_names=%s\n", strings.Join(names, ","))
+	fmt.Fprintf(&content, "package_versions=%s\n", strings.Join(versions, ","))
+	fmt.Fprintf(&content, "keys=%s\n", strings.Join(keys, ","))
+	fmt.Fprintf(&content, "urls=%s\n", strings.Join(urls, ","))
+	fmt.Fprintf(&content, "distros=%s\n", strings.Join(distros, ","))
+	return content.String(), nil
+}
+
+// formatSummary formats the job summary: a table of the published packages
+// and the distros that were updated.
+func formatSummary(cfg *config.Config, base string, packages []reportedPackage, distros []string) string {
+	var content strings.Builder
+	fmt.Fprintf(&content, "### update-apt-source %s\n\n", cfg.Command)
+	fmt.Fprintf(&content, "Repository: %s\n\n", base)
+	if len(packages) > 0 {
+		content.WriteString("| Package | Version | Architecture | Distribution | Component | File |\n")
+		content.WriteString("|---|---|---|---|---|---|\n")
+		for _, pkg := range packages {
+			fmt.Fprintf(&content, "| %s | %s | %s | %s | %s | [%s](%s) |\n",
+				pkg.Name, pkg.Version, pkg.Architecture, pkg.Distro, pkg.Component, pkg.Key, pkg.URL)
+		}
+		content.WriteString("\n")
+	}
+	if len(distros) > 0 {
+		fmt.Fprintf(&content, "Updated distributions: `%s`\n", strings.Join(distros, "`, `"))
+	} else {
+		content.WriteString("No distribution was updated.\n")
+	}
+	return content.String()
+}
+
+// appendFile appends content to a file the runner reads after the step.
+func appendFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	"github.com/coscene-io/update-apt-source/logging"
+)
+
+// runParallel runs n tasks on at most concurrency goroutines. Each task
+// logs its progress to its own buffer, and the buffers are flushed to
+// stderr in task order as soon as every earlier task is done, so output is
+// never interleaved. Once a task fails no further tasks are started, and the
+// error of the earliest failed task is returned.
+func runParallel(concurrency, n int, task func(i int, log *slog.Logger) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	outputs := make([]bytes.Buffer, n)
+	errs := make([]error, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var failed atomic.Bool
+	sem := make(chan struct{}, concurrency)
+	go func() {
+		for i := 0; i < n; i++ {
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-sem
+					close(done[i])
+				}()
+				// Tasks start in order, so every skipped task comes after
+				// the one that failed.
+				if failed.Load() {
+					return
+				}
+				if errs[i] = task(i, logging.New(&outputs[i])); errs[i] != nil {
+					failed.Store(true)
+				}
+			}(i)
+		}
+	}()
+
+	var firstErr error
+	for i := 0; i < n; i++ {
+		<-done[i]
+		os.Stderr.Write(outputs[i].Bytes())
+		if errs[i] != nil && firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	return firstErr
+}
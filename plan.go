@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/release"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// printPlan prints the changes a dry run captured: the packages added,
+// replaced and removed per Packages index, the entries changed per Release
+// file, and every object that would be written, linked or deleted. Current
+// contents are read from storageProvider, which must not be the recorder.
+func printPlan(storageProvider storage.StorageProvider, recorder *storage.Recorder, bucketName string, out io.Writer) error {
+	changes := recorder.Changes()
+	if len(changes) == 0 {
+		fmt.Fprintf(out, "\nDry run: no changes\n")
+		return nil
+	}
+
+	fmt.Fprintf(out, "\nDry run, planned changes:\n")
+	for _, change := range changes {
+		if change.Kind == storage.ChangeLink || path.Base(change.Key) != "Packages" {
+			continue
+		}
+		before, err := currentContent(storageProvider, bucketName, change.Key)
+		if err != nil {
+			return err
+		}
+		after, _ := recorder.Content(change.Key)
+		lines := diffPackages(deb.ParsePackagesFile(bytes.NewReader(before)), deb.ParsePackagesFile(bytes.NewReader(after)))
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s:\n", change.Key)
+		for _, line := range lines {
+			fmt.Fprintf(out, "    %s\n", line)
+		}
+	}
+
+	for _, change := range changes {
+		if change.Kind != storage.ChangePut || path.Base(change.Key) != "Release" {
+			continue
+		}
+		before, err := currentContent(storageProvider, bucketName, change.Key)
+		if err != nil {
+			return err
+		}
+		after, _ := recorder.Content(change.Key)
+		lines := diffRelease(release.ParseReleaseFile(bytes.NewReader(before)), release.ParseReleaseFile(bytes.NewReader(after)))
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s:\n", change.Key)
+		for _, line := range lines {
+			fmt.Fprintf(out, "    %s\n", line)
+		}
+	}
+
+	var written int64
+	var puts, links, deletes int
+	fmt.Fprintf(out, "\nObjects:\n")
+	for _, change := range changes {
+		switch change.Kind {
+		case storage.ChangePut:
+			puts++
+			written += change.Size
+			fmt.Fprintf(out, "    put    %s (%d bytes)\n", change.Key, change.Size)
+		case storage.ChangeLink:
+			links++
+			fmt.Fprintf(out, "    link   %s -> %s\n", change.Key, change.Target)
+		case storage.ChangeDelete:
+			deletes++
+			fmt.Fprintf(out, "    delete %s\n", change.Key)
+		}
+	}
+	fmt.Fprintf(out, "\nWould put %d objects, create %d links and delete %d objects\n", puts, links, deletes)
+	fmt.Fprintf(out, "Would write %s\n", formatBytes(written))
+	return nil
+}
+
+// currentContent returns the content of key in the bucket, or nil if it
+// does not exist yet.
+func currentContent(storageProvider storage.StorageProvider, bucketName, key string) ([]byte, error) {
+	content, err := storageProvider.GetObject(bucketName, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s failed: %v", key, err)
+	}
+	return content, nil
+}
+
+// diffPackages describes how a Packages index changes, one line per added,
+// replaced or removed package, sorted by package name.
+func diffPackages(before, after map[string]*deb.DebFileInfo) []string {
+	var lines []string
+	for name, pkg := range after {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("add     %s %s", name, pkg.Version))
+		case old.Version != pkg.Version:
+			lines = append(lines, fmt.Sprintf("replace %s %s -> %s", name, old.Version, pkg.Version))
+		case old.SHA256 != pkg.SHA256 || old.Filename != pkg.Filename:
+			lines = append(lines, fmt.Sprintf("replace %s %s (new file %s)", name, pkg.Version, pkg.Filename))
+		}
+	}
+	for name, pkg := range before {
+		if _, ok := after[name]; !ok {
+			lines = append(lines, fmt.Sprintf("remove  %s %s", name, pkg.Version))
+		}
+	}
+	slices.SortFunc(lines, func(a, b string) int {
+		return strings.Compare(a[8:], b[8:])
+	})
+	return lines
+}
+
+// diffRelease describes how the SHA256 entries of a Release file change,
+// one line per added, changed or removed index, sorted by path.
+func diffRelease(before, after *release.DistroRelease) []string {
+	var lines []string
+	for p, entry := range after.SHA256 {
+		old, ok := before.SHA256[p]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("add     %s (%d bytes)", p, entry.Size))
+		case old.Sum != entry.Sum:
+			lines = append(lines, fmt.Sprintf("change  %s (%d -> %d bytes)", p, old.Size, entry.Size))
+		}
+	}
+	for p := range before.SHA256 {
+		if _, ok := after.SHA256[p]; !ok {
+			lines = append(lines, fmt.Sprintf("remove  %s", p))
+		}
+	}
+	slices.SortFunc(lines, func(a, b string) int {
+		return strings.Compare(a[8:], b[8:])
+	})
+	return lines
+}
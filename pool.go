@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// poolPath returns the Debian pool location of a package file,
+// pool/<component>/<prefix>/<source>/<filename>, where prefix is the first
+// letter of the source package, or its first four letters for lib* sources.
+func poolPath(component string, debInfo *deb.DebFileInfo, filename string) string {
+	source := debInfo.SourceName()
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+	return fmt.Sprintf("pool/%s/%s/%s/%s", component, prefix, source, filename)
+}
+
+// splitPackagesKey splits the key of a Packages index below dists/ into its
+// distro and index directory, e.g. jammy/main/binary-amd64/Packages into
+// jammy and main/binary-amd64.
+func splitPackagesKey(key string) (distro, dir string, ok bool) {
+	rel, found := strings.CutPrefix(key, "dists/")
+	if !found || path.Base(rel) != "Packages" {
+		return "", "", false
+	}
+	distro, rest, found := strings.Cut(rel, "/")
+	if !found {
+		return "", "", false
+	}
+	dir = path.Dir(rest)
+	if !strings.Contains(dir, "/binary-") {
+		return "", "", false
+	}
+	return distro, dir, true
+}
+
+// migrateToPool moves the packages of a repository in the dists layout into
+// the pool layout. Every package referenced from a Packages index is copied
+// to its pool path once, the indexes are rewritten to point there and the
+// Release files re-signed, and the old objects are deleted last unless an
+// index that is not being migrated still references them. The _latest_
+// aliases of the deleted files move to the pool with them.
+func migrateToPool(storageProvider storage.StorageProvider, cfg *config.Config, rep *report) error {
+	logging.Group("Scan repository")
+	objects, err := storageProvider.ListObjects(cfg.BucketName, "dists/")
+	if err != nil {
+		return fmt.Errorf("list repository failed: %v", err)
+	}
+
+	var distros []string
+	dirs := make(map[string][]string)
+	keep := make(map[string]bool)
+	for _, obj := range objects {
+		distro, dir, ok := splitPackagesKey(obj.Key)
+		if !ok {
+			continue
+		}
+		// Suite aliases are mirrored from their codename when it is updated.
+		if _, ok := cfg.Repo.Suites[distro]; ok {
+			continue
+		}
+		if cfg.UbuntuDistro != config.AllDistros && distro != cfg.UbuntuDistro {
+			content, err := storageProvider.GetObject(cfg.BucketName, obj.Key)
+			if err != nil {
+				return fmt.Errorf("get %s failed: %v", obj.Key, err)
+			}
+			for _, pkg := range deb.ParsePackagesFile(bytes.NewReader(content)) {
+				keep[pkg.Filename] = true
+			}
+			continue
+		}
+		if _, ok := dirs[distro]; !ok {
+			distros = append(distros, distro)
+		}
+		dirs[distro] = append(dirs[distro], dir)
+	}
+
+	moves := make(map[string]string)
+	var moveOrder []string
+	poolSums := make(map[string]string)
+	versions := make(map[string]string)
+	var updates []*distroUpdate
+	for _, distro := range distros {
+		logging.Group("Ubuntu Distro: " + distro)
+		update := &distroUpdate{distro: distro}
+		indexes := make(map[string][]byte)
+		for _, dir := range dirs[distro] {
+			key := fmt.Sprintf("dists/%s/%s/Packages", distro, dir)
+			content, err := storageProvider.GetObject(cfg.BucketName, key)
+			if err != nil {
+				return fmt.Errorf("get %s failed: %v", key, err)
+			}
+
+			packages := deb.ParsePackagesFile(bytes.NewReader(content))
+			component, _, _ := strings.Cut(dir, "/binary-")
+			moved := 0
+			for _, pkg := range packages {
+				if strings.HasPrefix(pkg.Filename, "pool/") {
+					continue
+				}
+				newPath, ok := moves[pkg.Filename]
+				if !ok {
+					newPath = poolPath(component, pkg, path.Base(pkg.Filename))
+					moves[pkg.Filename] = newPath
+					moveOrder = append(moveOrder, pkg.Filename)
+				}
+				// The pool holds a single object per file name, so packages
+				// that only shared a name in the dists layout cannot move.
+				if sum, ok := poolSums[newPath]; ok && sum != pkg.SHA256 {
+					return fmt.Errorf("%s and another package with different content would both move to %s", pkg.Filename, newPath)
+				}
+				poolSums[newPath] = pkg.SHA256
+				versions[newPath] = pkg.Version
+				pkg.Filename = newPath
+				moved++
+			}
+			if moved == 0 {
+				continue
+			}
+
+			slog.Info("moving packages to pool", "distro", distro, "index", dir, "packages", moved)
+			objects, err := stagePackages(cfg, distro, dir, formatPackages(packages), indexes)
+			if err != nil {
+				return err
+			}
+			update.indexObjects = append(update.indexObjects, objects...)
+		}
+
+		if len(indexes) == 0 {
+			slog.Info("already in pool layout", "distro", distro)
+			continue
+		}
+		update.releaseObjects, err = stageRelease(storageProvider, cfg, distro, indexes, slog.With("distro", distro))
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update)
+	}
+
+	if len(moveOrder) == 0 {
+		slog.Info("nothing to migrate")
+		return nil
+	}
+
+	logging.Group("Copy packages to pool")
+	err = runParallel(cfg.Concurrency, len(moveOrder), func(i int, log *slog.Logger) error {
+		oldPath := moveOrder[i]
+		log.Info("copying package to pool", "key", oldPath, "target", moves[oldPath])
+		content, err := storageProvider.GetObject(cfg.BucketName, oldPath)
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", oldPath, err)
+		}
+		if err := storageProvider.PutObject(cfg.BucketName, moves[oldPath], content); err != nil {
+			return fmt.Errorf("upload %s failed: %v", moves[oldPath], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := publishUpdates(storageProvider, cfg, updates, rep); err != nil {
+		return err
+	}
+
+	obsolete := slices.DeleteFunc(moveOrder, func(oldPath string) bool {
+		return keep[oldPath]
+	})
+	aliases, err := migrateLatestAliases(storageProvider, cfg, objects, moves, versions, obsolete)
+	if err != nil {
+		return err
+	}
+	obsolete = append(obsolete, aliases...)
+	slog.Info("deleting migrated packages", "count", len(obsolete))
+	if err := deleteObjects(storageProvider, cfg.BucketName, obsolete, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateLatestAliases recreates the _latest_ aliases that point at package
+// files the migration deletes next to the pool copies of those files, where
+// publish keeps them in the pool layout. An alias that several migrated
+// aliases map to points at the highest version. It returns the old aliases,
+// which are deleted along with their files.
+func migrateLatestAliases(storageProvider storage.StorageProvider, cfg *config.Config, objects []storage.ObjectInfo, moves, versions map[string]string, obsolete []string) ([]string, error) {
+	var stale []string
+	latest := make(map[string]string)
+	for _, obj := range objects {
+		if !strings.Contains(path.Base(obj.Key), "_latest_") {
+			continue
+		}
+		target, err := storageProvider.GetSymlinkTarget(cfg.BucketName, obj.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read link %s failed: %v", obj.Key, err)
+		}
+		if !slices.Contains(obsolete, target) {
+			continue
+		}
+		stale = append(stale, obj.Key)
+
+		newPath := moves[target]
+		alias := path.Join(path.Dir(newPath), path.Base(obj.Key))
+		if current, ok := latest[alias]; !ok || deb.CompareVersions(versions[newPath], versions[current]) > 0 {
+			latest[alias] = newPath
+		}
+	}
+	if len(latest) == 0 {
+		return stale, nil
+	}
+
+	logging.Group("Move latest aliases to pool")
+	aliases := slices.Sorted(maps.Keys(latest))
+	err := runParallel(cfg.Concurrency, len(aliases), func(i int, log *slog.Logger) error {
+		alias := aliases[i]
+		log.Info("creating redirect", "key", alias, "target", latest[alias])
+		if err := storageProvider.CreateSymlink(cfg.BucketName, latest[alias], alias); err != nil {
+			return fmt.Errorf("create redirect %s failed: %v", alias, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/storage/storagetest"
+)
+
+func TestMigrateLatestAliases(t *testing.T) {
+	const (
+		jammy = "dists/jammy/main/binary-amd64/"
+		focal = "dists/focal/main/binary-amd64/"
+		pool  = "pool/main/f/foo/"
+	)
+	sp := storagetest.NewMemory()
+	sp.PutObject("", jammy+"foo_1.0_amd64.deb", []byte("1.0"))
+	sp.CreateSymlink("", jammy+"foo_1.0_amd64.deb", jammy+"foo_latest_amd64.deb")
+	sp.PutObject("", focal+"foo_2.0_amd64.deb", []byte("2.0"))
+	sp.CreateSymlink("", focal+"foo_2.0_amd64.deb", focal+"foo_latest_amd64.deb")
+	sp.PutObject("", focal+"bar_1.0_amd64.deb", []byte("bar"))
+	sp.CreateSymlink("", focal+"bar_1.0_amd64.deb", focal+"bar_latest_amd64.deb")
+	objects, _ := sp.ListObjects("", "dists/")
+
+	moves := map[string]string{
+		jammy + "foo_1.0_amd64.deb": pool + "foo_1.0_amd64.deb",
+		focal + "foo_2.0_amd64.deb": pool + "foo_2.0_amd64.deb",
+	}
+	versions := map[string]string{
+		pool + "foo_1.0_amd64.deb": "1.0",
+		pool + "foo_2.0_amd64.deb": "2.0",
+	}
+	cfg := &config.Config{Concurrency: 2}
+	obsolete := []string{jammy + "foo_1.0_amd64.deb", focal + "foo_2.0_amd64.deb"}
+	stale, err := migrateLatestAliases(sp, cfg, objects, moves, versions, obsolete)
+	if err != nil {
+		t.Fatalf("migrateLatestAliases failed: %v", err)
+	}
+
+	slices.Sort(stale)
+	if want := []string{focal + "foo_latest_amd64.deb", jammy + "foo_latest_amd64.deb"}; !slices.Equal(stale, want) {
+		t.Errorf("stale aliases are %v, want %v", stale, want)
+	}
+	if target, _ := sp.GetSymlinkTarget("", pool+"foo_latest_amd64.deb"); target != pool+"foo_2.0_amd64.deb" {
+		t.Errorf("pool alias points at %q, want %q", target, pool+"foo_2.0_amd64.deb")
+	}
+	if target, _ := sp.GetSymlinkTarget("", focal+"bar_latest_amd64.deb"); target != focal+"bar_1.0_amd64.deb" {
+		t.Errorf("alias of a package that is not migrated points at %q", target)
+	}
+}
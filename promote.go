@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// promote copies the Packages entry of an already published package from
+// one distro and component into another without uploading it again. The
+// target entry reuses the stored .deb, either directly when it already lives
+// in the right place, or through a link created with CreateSymlink. Only the
+// Release files of the target distros are re-signed.
+func promote(storageProvider storage.StorageProvider, cfg *config.Config, rep *report) error {
+	sourceComponent := cfg.SourceComponentOrDefault()
+	targetComponent := cfg.ComponentFor(cfg.UbuntuDistro)
+	targets := []string{cfg.UbuntuDistro}
+	if cfg.UbuntuDistro == config.AllDistros {
+		targets = cfg.Repo.AllDistributions
+	}
+
+	architectures := cfg.Architectures
+	if len(architectures) == 0 {
+		var err error
+		architectures, err = listArchitectures(storageProvider, cfg.BucketName, cfg.SourceDistro, sourceComponent)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch := newPublishBatch()
+	var links []debLink
+	found := 0
+	logging.Group(fmt.Sprintf("Find %s in %s/%s", cfg.PackageName, cfg.SourceDistro, sourceComponent))
+	for _, arch := range architectures {
+		source := indexKey{cfg.SourceDistro, sourceComponent, arch}
+		packagesPath := fmt.Sprintf("dists/%s/%s/Packages", source.Distro, source.Path())
+		content, err := storageProvider.GetObject(cfg.BucketName, packagesPath)
+		if errors.Is(err, storage.ErrNotFound) {
+			slog.Info("no Packages index", "architecture", arch)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", packagesPath, err)
+		}
+
+		pkg, ok := deb.ParsePackagesFile(bytes.NewReader(content))[cfg.PackageName]
+		if !ok {
+			slog.Info("package not published", "architecture", arch)
+			continue
+		}
+		if cfg.PackageVersion != "" && pkg.Version != cfg.PackageVersion {
+			return fmt.Errorf("%s/%s has %s version %s, not %s", source.Distro, source.Path(), pkg.Name, pkg.Version, cfg.PackageVersion)
+		}
+		slog.Info("found package", "architecture", arch, "package", pkg.Name, "version", pkg.Version, "key", pkg.Filename)
+		found++
+
+		for _, target := range targets {
+			promoted := *pkg
+			if !canShareFile(cfg, targetComponent, pkg) {
+				if strings.HasPrefix(pkg.Filename, "pool/") {
+					promoted.Filename = poolPath(targetComponent, pkg, path.Base(pkg.Filename))
+				} else {
+					promoted.Filename = fmt.Sprintf("dists/%s/%s/binary-%s/%s", target, targetComponent, arch, path.Base(pkg.Filename))
+				}
+				links = append(links, debLink{pkg.Filename, &promoted})
+			}
+			batch.add(indexKey{target, targetComponent, arch}, &promoted)
+		}
+	}
+	if found == 0 {
+		return fmt.Errorf("package %s is not published in %s/%s", cfg.PackageName, cfg.SourceDistro, sourceComponent)
+	}
+
+	if err := createDebLinks(storageProvider, cfg, links); err != nil {
+		return err
+	}
+
+	logging.Group("Build indexes")
+	updates := make([]*distroUpdate, len(batch.distros))
+	err := runParallel(cfg.Concurrency, len(batch.distros), func(i int, log *slog.Logger) error {
+		distro := batch.distros[i]
+		update, err := buildDistro(storageProvider, cfg, batch, distro, log.With("distro", distro))
+		if err != nil {
+			return err
+		}
+		updates[i] = update
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := publishUpdates(storageProvider, cfg, updates, rep); err != nil {
+		return err
+	}
+	rep.addPackages(batch)
+	return nil
+}
+
+// canShareFile reports whether a promoted package can point at the stored
+// .deb as is: pool files and deduplicated files are shared by every distro,
+// as long as they already live in the target component.
+func canShareFile(cfg *config.Config, component string, pkg *deb.DebFileInfo) bool {
+	if checkComponent(component, pkg) != nil {
+		return false
+	}
+	return strings.HasPrefix(pkg.Filename, "pool/") || cfg.SymlinkStrategy == storage.SymlinkDedup
+}
+
+// listArchitectures returns the architectures that have a Packages index in
+// a component of a distro.
+func listArchitectures(storageProvider storage.StorageProvider, bucketName, distro, component string) ([]string, error) {
+	prefix := fmt.Sprintf("dists/%s/%s/", distro, component)
+	objects, err := storageProvider.ListObjects(bucketName, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list %s failed: %v", prefix, err)
+	}
+
+	var architectures []string
+	for _, obj := range objects {
+		_, dir, ok := splitPackagesKey(obj.Key)
+		if !ok {
+			continue
+		}
+		c, arch, _ := strings.Cut(dir, "/binary-")
+		if c == component {
+			architectures = append(architectures, arch)
+		}
+	}
+	return architectures, nil
+}
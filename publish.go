@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/release"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// indexKey identifies one binary Packages index of the repository.
+type indexKey struct {
+	Distro       string
+	Component    string
+	Architecture string
+}
+
+// Path returns the index directory relative to dists/<distro>/.
+func (k indexKey) Path() string {
+	return fmt.Sprintf("%s/binary-%s", k.Component, k.Architecture)
+}
+
+// publishBatch collects every package uploaded in one run, grouped by the
+// index it belongs to, so that each index is rewritten and each distro's
+// Release is signed only once however many packages are published.
+type publishBatch struct {
+	distros  []string
+	indexes  map[string][]indexKey
+	packages map[indexKey][]*deb.DebFileInfo
+}
+
+func newPublishBatch() *publishBatch {
+	return &publishBatch{
+		indexes:  make(map[string][]indexKey),
+		packages: make(map[indexKey][]*deb.DebFileInfo),
+	}
+}
+
+func (b *publishBatch) add(key indexKey, debInfo *deb.DebFileInfo) {
+	if _, ok := b.indexes[key.Distro]; !ok {
+		b.distros = append(b.distros, key.Distro)
+	}
+	if _, ok := b.packages[key]; !ok {
+		b.indexes[key.Distro] = append(b.indexes[key.Distro], key)
+	}
+	b.packages[key] = append(b.packages[key], debInfo)
+}
+
+type stagedObject struct {
+	key     string
+	content []byte
+}
+
+// distroUpdate holds the staged changes of one distro: its rewritten indexes
+// and its re-signed Release files.
+type distroUpdate struct {
+	distro         string
+	indexObjects   []stagedObject
+	releaseObjects []stagedObject
+}
+
+// publish uploads every package first, then builds all indexes and signed
+// Release files in memory, and only then uploads the indexes followed by the
+// Release files and signatures, so clients never see a signed Release that
+// does not match the indexes it lists. Packages, redirects and distros are
+// processed on up to cfg.Concurrency goroutines.
+func publish(storageProvider storage.StorageProvider, cfg *config.Config, configList []*config.SingleConfig, rep *report) error {
+	logging.Group("Upload packages")
+	debInfos := make([]*deb.DebFileInfo, len(configList))
+	err := runParallel(cfg.Concurrency, len(configList), func(i int, log *slog.Logger) error {
+		c := configList[i]
+		log = log.With("package", fmt.Sprintf("%d/%d", i+1, len(configList)), "architecture", c.Architecture, "path", c.DebPath)
+		log.Info("uploading deb package")
+		debInfo, err := uploadDebFile(storageProvider, cfg.BucketName, c, log)
+		if err != nil {
+			return fmt.Errorf("upload deb package failed: %v", err)
+		}
+		debInfos[i] = debInfo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := newPublishBatch()
+	var links []debLink
+	for i, c := range configList {
+		if c.UbuntuDistro != config.AllDistros {
+			batch.add(indexKey{c.UbuntuDistro, c.Container, c.Architecture}, debInfos[i])
+			continue
+		}
+		for _, d := range cfg.Repo.AllDistributions {
+			// With deduplication or the pool layout every distro's index
+			// points at the one uploaded object instead of a link to it.
+			if cfg.SymlinkStrategy == storage.SymlinkDedup || cfg.Layout == config.LayoutPool {
+				batch.add(indexKey{d, c.Container, c.Architecture}, debInfos[i])
+				continue
+			}
+			linked := *debInfos[i]
+			linked.Filename = fmt.Sprintf("dists/%s/%s/binary-%s/%s", d, c.Container, c.Architecture, filepath.Base(c.DebPath))
+			links = append(links, debLink{debInfos[i].Filename, &linked})
+			batch.add(indexKey{d, c.Container, c.Architecture}, &linked)
+		}
+	}
+
+	if err := createDebLinks(storageProvider, cfg, links); err != nil {
+		return err
+	}
+
+	logging.Group("Build indexes")
+	updates := make([]*distroUpdate, len(batch.distros))
+	err = runParallel(cfg.Concurrency, len(batch.distros), func(i int, log *slog.Logger) error {
+		distro := batch.distros[i]
+		update, err := buildDistro(storageProvider, cfg, batch, distro, log.With("distro", distro))
+		if err != nil {
+			return err
+		}
+		updates[i] = update
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := publishUpdates(storageProvider, cfg, updates, rep); err != nil {
+		return err
+	}
+	rep.addPackages(batch)
+	return nil
+}
+
+// debLink is a package file that a Packages entry points at through a link
+// to the stored .deb.
+type debLink struct {
+	target  string
+	debInfo *deb.DebFileInfo
+}
+
+// createDebLinks creates the links of the package files that the entries of
+// a batch point at, on up to cfg.Concurrency goroutines.
+func createDebLinks(storageProvider storage.StorageProvider, cfg *config.Config, links []debLink) error {
+	if len(links) == 0 {
+		return nil
+	}
+	logging.Group("Create deb file redirects")
+	return runParallel(cfg.Concurrency, len(links), func(i int, log *slog.Logger) error {
+		link := links[i]
+		log.Info("creating deb file redirect", "key", link.debInfo.Filename, "target", link.target)
+		if err := storageProvider.CreateSymlink(cfg.BucketName, link.target, link.debInfo.Filename); err != nil {
+			return fmt.Errorf("create redirect %s failed: %v", link.debInfo.Filename, err)
+		}
+		return nil
+	})
+}
+
+// publishUpdates uploads the staged indexes of every distro, then their
+// Release files and signatures. Distros that are the target of a suite are
+// mirrored to dists/<suite>/ along the way. The updated distros are added to
+// rep.
+func publishUpdates(storageProvider storage.StorageProvider, cfg *config.Config, updates []*distroUpdate, rep *report) error {
+	logging.Group("Publish indexes")
+	var indexObjects, releaseObjects []stagedObject
+	var obsolete []string
+	for _, update := range updates {
+		indexObjects = append(indexObjects, update.indexObjects...)
+		releaseObjects = append(releaseObjects, update.releaseObjects...)
+
+		suite := cfg.Repo.SuiteFor(update.distro)
+		if suite == "" {
+			continue
+		}
+		slog.Info("mirroring distro to suite", "distro", update.distro, "suite", suite)
+		alias, err := stageSuiteAlias(storageProvider, cfg.BucketName, update, suite)
+		if err != nil {
+			return err
+		}
+		indexObjects = append(indexObjects, alias.indexObjects...)
+		releaseObjects = append(releaseObjects, alias.releaseObjects...)
+		obsolete = append(obsolete, alias.obsolete...)
+	}
+
+	slog.Info("publishing indexes", "count", len(indexObjects))
+	if err := putObjects(storageProvider, cfg.BucketName, indexObjects, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	slog.Info("publishing Release files and signatures", "count", len(releaseObjects))
+	if err := putObjects(storageProvider, cfg.BucketName, releaseObjects, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	if len(obsolete) > 0 {
+		slog.Info("deleting stale suite indexes", "count", len(obsolete))
+		if err := deleteObjects(storageProvider, cfg.BucketName, obsolete, cfg.Concurrency); err != nil {
+			return err
+		}
+	}
+
+	for _, update := range updates {
+		rep.addDistro(update.distro)
+	}
+	return nil
+}
+
+type suiteAlias struct {
+	indexObjects   []stagedObject
+	releaseObjects []stagedObject
+	obsolete       []string
+}
+
+// stageSuiteAlias stages a copy of every index and Release file of a distro,
+// with the staged versions taking precedence over the ones in the bucket,
+// under dists/<suite>/. Index files under the alias that the distro no
+// longer has are returned as obsolete. Package files are not copied: their
+// Filename is relative to the repository root and stays valid.
+func stageSuiteAlias(storageProvider storage.StorageProvider, bucketName string, update *distroUpdate, suite string) (*suiteAlias, error) {
+	distroPrefix := fmt.Sprintf("dists/%s/", update.distro)
+	suitePrefix := fmt.Sprintf("dists/%s/", suite)
+
+	staged := make(map[string]bool)
+	alias := &suiteAlias{}
+	for _, o := range update.indexObjects {
+		staged[o.key] = true
+		alias.indexObjects = append(alias.indexObjects, stagedObject{suitePrefix + strings.TrimPrefix(o.key, distroPrefix), o.content})
+	}
+	for _, o := range update.releaseObjects {
+		staged[o.key] = true
+		alias.releaseObjects = append(alias.releaseObjects, stagedObject{suitePrefix + strings.TrimPrefix(o.key, distroPrefix), o.content})
+	}
+
+	objects, err := storageProvider.ListObjects(bucketName, distroPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list %s failed: %v", distroPrefix, err)
+	}
+	mirrored := make(map[string]bool)
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, distroPrefix)
+		if !release.IsIndexFile(rel) && !release.IsReleaseFile(rel) {
+			continue
+		}
+		mirrored[rel] = true
+		if staged[obj.Key] {
+			continue
+		}
+		content, err := storageProvider.GetObject(bucketName, obj.Key)
+		if err != nil {
+			return nil, fmt.Errorf("get %s failed: %v", obj.Key, err)
+		}
+		if release.IsReleaseFile(rel) {
+			alias.releaseObjects = append(alias.releaseObjects, stagedObject{suitePrefix + rel, content})
+		} else {
+			alias.indexObjects = append(alias.indexObjects, stagedObject{suitePrefix + rel, content})
+		}
+	}
+	for key := range staged {
+		mirrored[strings.TrimPrefix(key, distroPrefix)] = true
+	}
+
+	existing, err := storageProvider.ListObjects(bucketName, suitePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list %s failed: %v", suitePrefix, err)
+	}
+	for _, obj := range existing {
+		rel := strings.TrimPrefix(obj.Key, suitePrefix)
+		if (release.IsIndexFile(rel) || release.IsReleaseFile(rel)) && !mirrored[rel] {
+			alias.obsolete = append(alias.obsolete, obj.Key)
+		}
+	}
+	return alias, nil
+}
+
+// buildDistro builds the updated indexes of a distro and its signed Release
+// files without touching the bucket.
+func buildDistro(storageProvider storage.StorageProvider, cfg *config.Config, batch *publishBatch, distro string, log *slog.Logger) (*distroUpdate, error) {
+	update := &distroUpdate{distro: distro}
+	indexes := make(map[string][]byte)
+	for _, key := range batch.indexes[distro] {
+		for _, debInfo := range batch.packages[key] {
+			if err := checkComponent(key.Component, debInfo); err != nil {
+				return nil, err
+			}
+		}
+
+		log.Info("updating Packages file", "index", key.Path(), "packages", len(batch.packages[key]))
+		packagesContent, err := updatePackages(storageProvider, cfg.BucketName, key, batch.packages[key])
+		if err != nil {
+			return nil, fmt.Errorf("update Packages failed: %v", err)
+		}
+
+		objects, err := stagePackages(cfg, distro, key.Path(), packagesContent, indexes)
+		if err != nil {
+			return nil, err
+		}
+		update.indexObjects = append(update.indexObjects, objects...)
+	}
+
+	releaseObjects, err := stageRelease(storageProvider, cfg, distro, indexes, log)
+	if err != nil {
+		return nil, err
+	}
+	update.releaseObjects = releaseObjects
+	return update, nil
+}
+
+// stagePackages stages a Packages file and its variants in the configured
+// compressions for the index directory dir of a distro, and records them in
+// indexes, keyed by their path relative to dists/<distro>/, for the Release
+// file.
+func stagePackages(cfg *config.Config, distro, dir, packagesContent string, indexes map[string][]byte) ([]stagedObject, error) {
+	indexes[dir+"/Packages"] = []byte(packagesContent)
+	objects := []stagedObject{
+		{fmt.Sprintf("dists/%s/%s/Packages", distro, dir), []byte(packagesContent)},
+	}
+	for _, compression := range cfg.Repo.Compressions {
+		var content []byte
+		var err error
+		switch compression {
+		case config.CompressionGzip:
+			content, err = generatePackagesGz(packagesContent)
+		case config.CompressionXz:
+			content, err = generatePackagesXz(packagesContent)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("generate %s/Packages.%s failed: %v", dir, compression, err)
+		}
+		indexes[dir+"/Packages."+compression] = content
+		objects = append(objects, stagedObject{fmt.Sprintf("dists/%s/%s/Packages.%s", distro, dir, compression), content})
+	}
+	return objects, nil
+}
+
+// stageRelease stages the updated Release file of a distro and its
+// signatures.
+func stageRelease(storageProvider storage.StorageProvider, cfg *config.Config, distro string, indexes map[string][]byte, log *slog.Logger) ([]stagedObject, error) {
+	log.Info("updating Release file")
+	releaseContent, err := updateRelease(storageProvider, cfg.BucketName, distro, &cfg.Repo, indexes, cfg.FullRelease)
+	if err != nil {
+		return nil, fmt.Errorf("update Release failed: %v", err)
+	}
+
+	log.Info("signing Release file")
+	releaseGpg, inRelease, err := signReleaseFiles(releaseContent, &cfg.GpgPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign files failed: %v", err)
+	}
+
+	return []stagedObject{
+		{fmt.Sprintf("dists/%s/Release", distro), []byte(releaseContent)},
+		{fmt.Sprintf("dists/%s/Release.gpg", distro), releaseGpg},
+		{fmt.Sprintf("dists/%s/InRelease", distro), inRelease},
+	}, nil
+}
+
+// checkComponent verifies that the file of a package lives in the component
+// whose index it is being added to, in either the dists or the pool layout.
+func checkComponent(component string, debInfo *deb.DebFileInfo) error {
+	parts := strings.Split(debInfo.Filename, "/")
+	switch {
+	case len(parts) > 2 && parts[0] == "pool" && parts[1] == component:
+		return nil
+	case len(parts) > 3 && parts[0] == "dists" && parts[2] == component:
+		return nil
+	}
+	return fmt.Errorf("package %s is stored at %s, which is not in component %s", debInfo.Name, debInfo.Filename, component)
+}
+
+func deleteObjects(storageProvider storage.StorageProvider, bucketName string, keys []string, concurrency int) error {
+	return runParallel(concurrency, len(keys), func(i int, log *slog.Logger) error {
+		if err := storageProvider.DeleteObject(bucketName, keys[i]); err != nil {
+			return fmt.Errorf("delete %s failed: %v", keys[i], err)
+		}
+		return nil
+	})
+}
+
+func putObjects(storageProvider storage.StorageProvider, bucketName string, objects []stagedObject, concurrency int) error {
+	return runParallel(concurrency, len(objects), func(i int, log *slog.Logger) error {
+		if err := storageProvider.PutObject(bucketName, objects[i].key, objects[i].content); err != nil {
+			return fmt.Errorf("upload %s failed: %v", objects[i].key, err)
+		}
+		return nil
+	})
+}
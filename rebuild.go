@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/release"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// rebuild regenerates the Packages indexes of the selected distros from the
+// .deb files stored in the bucket, for when an index was corrupted or lost.
+// Every package file is downloaded once to recreate its entry, and where an
+// index directory holds several versions of a package the highest one wins.
+//
+// In the dists layout an index is rebuilt from the files next to it, and
+// with the dedup strategy also from those uploaded for the all distro. In
+// the pool layout, which does not record which distro a package belongs to,
+// the distro gets every package of the component's pool for each of its
+// architectures, so only one distro can be rebuilt at a time.
+func rebuild(storageProvider storage.StorageProvider, cfg *config.Config, rep *report) error {
+	distros := selectedDistros(cfg)
+	if cfg.Layout == config.LayoutPool && len(distros) > 1 {
+		return fmt.Errorf("the pool layout does not record the distro of a package, rebuild one distro at a time instead of %d", len(distros))
+	}
+	prefix := "dists/"
+	if cfg.Layout == config.LayoutPool {
+		prefix = "pool/"
+	}
+
+	logging.Group("Scan repository")
+	objects, err := storageProvider.ListObjects(cfg.BucketName, prefix)
+	if err != nil {
+		return fmt.Errorf("list repository failed: %v", err)
+	}
+
+	// files maps every index to the keys of the package files it is rebuilt
+	// from. In the pool layout the index is only known once the file has
+	// been read, so files are collected per component instead.
+	files := make(map[indexKey][]string)
+	poolFiles := make(map[string][]string)
+	for _, obj := range objects {
+		// _latest_ aliases link to package files that are indexed already.
+		if !strings.HasSuffix(obj.Key, ".deb") || strings.Contains(path.Base(obj.Key), "_latest_") {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(obj.Key, prefix), "/")
+		if cfg.Layout == config.LayoutPool {
+			if cfg.Component == "" || parts[0] == cfg.Component {
+				poolFiles[parts[0]] = append(poolFiles[parts[0]], obj.Key)
+			}
+			continue
+		}
+
+		if len(parts) != 4 || !strings.HasPrefix(parts[2], "binary-") {
+			continue
+		}
+		distro, component, arch := parts[0], parts[1], strings.TrimPrefix(parts[2], "binary-")
+		if cfg.Component != "" && component != cfg.Component {
+			continue
+		}
+		if len(cfg.Architectures) > 0 && !slices.Contains(cfg.Architectures, arch) {
+			continue
+		}
+		for _, d := range distros {
+			shared := distro == config.AllDistros && cfg.SymlinkStrategy == storage.SymlinkDedup &&
+				slices.Contains(cfg.Repo.AllDistributions, d)
+			if distro == d || shared {
+				key := indexKey{d, component, arch}
+				files[key] = append(files[key], obj.Key)
+			}
+		}
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, list := range files {
+		for _, k := range list {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	for _, list := range poolFiles {
+		keys = append(keys, list...)
+	}
+	slices.Sort(keys)
+
+	if len(keys) == 0 {
+		slog.Info("no package files found")
+		return nil
+	}
+
+	logging.Group(fmt.Sprintf("Read %d package files", len(keys)))
+	infos := make([]*deb.DebFileInfo, len(keys))
+	err = runParallel(cfg.Concurrency, len(keys), func(i int, log *slog.Logger) error {
+		log.Info("reading package file", "key", keys[i])
+		content, err := storageProvider.GetObject(cfg.BucketName, keys[i])
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", keys[i], err)
+		}
+		debInfo, err := readDebInfo(content)
+		if err != nil {
+			return fmt.Errorf("read %s failed: %v", keys[i], err)
+		}
+		debInfo.Filename = keys[i]
+		infos[i] = debInfo
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	byKey := make(map[string]*deb.DebFileInfo, len(keys))
+	for i, k := range keys {
+		byKey[k] = infos[i]
+	}
+
+	for component, list := range poolFiles {
+		for _, d := range distros {
+			architectures, err := distroArchitectures(storageProvider, cfg, d)
+			if err != nil {
+				return err
+			}
+			for _, arch := range architectures {
+				key := indexKey{d, component, arch}
+				for _, k := range list {
+					if a := byKey[k].Architecture; a == arch || a == "all" {
+						files[key] = append(files[key], k)
+					}
+				}
+			}
+		}
+	}
+
+	var updates []*distroUpdate
+	for _, distro := range distros {
+		var distroKeys []indexKey
+		for key := range files {
+			if key.Distro == distro {
+				distroKeys = append(distroKeys, key)
+			}
+		}
+		if len(distroKeys) == 0 {
+			continue
+		}
+		slices.SortFunc(distroKeys, func(a, b indexKey) int {
+			return strings.Compare(a.Path(), b.Path())
+		})
+
+		logging.Group("Ubuntu Distro: " + distro)
+		update := &distroUpdate{distro: distro}
+		indexes := make(map[string][]byte)
+		for _, key := range distroKeys {
+			packages := make(map[string]*deb.DebFileInfo)
+			for _, k := range files[key] {
+				debInfo := byKey[k]
+				if current, ok := packages[debInfo.Name]; ok && deb.CompareVersions(current.Version, debInfo.Version) >= 0 {
+					continue
+				}
+				packages[debInfo.Name] = debInfo
+			}
+
+			slog.Info("rebuilding Packages file", "distro", distro, "index", key.Path(), "packages", len(packages))
+			objects, err := stagePackages(cfg, distro, key.Path(), formatPackages(packages), indexes)
+			if err != nil {
+				return err
+			}
+			update.indexObjects = append(update.indexObjects, objects...)
+		}
+
+		update.releaseObjects, err = stageRelease(storageProvider, cfg, distro, indexes, slog.With("distro", distro))
+		if err != nil {
+			return err
+		}
+		updates = append(updates, update)
+	}
+
+	if len(updates) == 0 {
+		slog.Info("no index to rebuild")
+		return nil
+	}
+	return publishUpdates(storageProvider, cfg, updates, rep)
+}
+
+// distroArchitectures returns the architectures to rebuild for a distro in
+// the pool layout: those of the run or of the repository config, or else
+// those its Release lists. Distros that were never published are skipped
+// when rebuilding all.
+func distroArchitectures(storageProvider storage.StorageProvider, cfg *config.Config, distro string) ([]string, error) {
+	if len(cfg.Architectures) > 0 {
+		return cfg.Architectures, nil
+	}
+	if len(cfg.Repo.Architectures) > 0 {
+		return cfg.Repo.Architectures, nil
+	}
+
+	releasePath := fmt.Sprintf("dists/%s/Release", distro)
+	content, err := storageProvider.GetObject(cfg.BucketName, releasePath)
+	if errors.Is(err, storage.ErrNotFound) && cfg.UbuntuDistro == config.AllDistros {
+		return nil, nil
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("%s is missing, set architectures to rebuild %s", releasePath, distro)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s failed: %v", releasePath, err)
+	}
+	return release.ParseReleaseFile(bytes.NewReader(content)).Architectures, nil
+}
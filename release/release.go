@@ -2,23 +2,32 @@ package release
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 type DistroRelease struct {
-	Origin      string
-	Label       string
-	Suite       string
-	Codename    string
-	Date        string
-	Description string
-	MD5Sum      map[string]*PackageInfo
-	SHA1        map[string]*PackageInfo
-	SHA256      map[string]*PackageInfo
-	SHA512      map[string]*PackageInfo
+	Origin        string
+	Label         string
+	Suite         string
+	Codename      string
+	Date          string
+	Architectures []string
+	Components    []string
+	Description   string
+	MD5Sum        map[string]*PackageInfo
+	SHA1          map[string]*PackageInfo
+	SHA256        map[string]*PackageInfo
+	SHA512        map[string]*PackageInfo
 }
 
 func (r *DistroRelease) ToString() string {
@@ -28,6 +37,12 @@ func (r *DistroRelease) ToString() string {
 	fmt.Fprintf(&content, "Suite: %s\n", r.Suite)
 	fmt.Fprintf(&content, "Codename: %s\n", r.Codename)
 	fmt.Fprintf(&content, "Date: %s\n", r.Date)
+	if len(r.Architectures) > 0 {
+		fmt.Fprintf(&content, "Architectures: %s\n", strings.Join(r.Architectures, " "))
+	}
+	if len(r.Components) > 0 {
+		fmt.Fprintf(&content, "Components: %s\n", strings.Join(r.Components, " "))
+	}
 	fmt.Fprintf(&content, "Description: %s\n", r.Description)
 
 	fmt.Fprintf(&content, "MD5Sum:\n")
@@ -53,6 +68,80 @@ func (r *DistroRelease) ToString() string {
 	return content.String()
 }
 
+// SetFile records the checksums and size of an index file, identified by its
+// path relative to the distro directory, replacing any previous entry.
+func (r *DistroRelease) SetFile(path string, content []byte) {
+	md5hash := md5.Sum(content)
+	sha1hash := sha1.Sum(content)
+	sha256hash := sha256.Sum256(content)
+	sha512hash := sha512.Sum512(content)
+
+	r.MD5Sum[path] = &PackageInfo{Sum: hex.EncodeToString(md5hash[:]), Size: len(content), Path: path}
+	r.SHA1[path] = &PackageInfo{Sum: hex.EncodeToString(sha1hash[:]), Size: len(content), Path: path}
+	r.SHA256[path] = &PackageInfo{Sum: hex.EncodeToString(sha256hash[:]), Size: len(content), Path: path}
+	r.SHA512[path] = &PackageInfo{Sum: hex.EncodeToString(sha512hash[:]), Size: len(content), Path: path}
+}
+
+// RemoveFile drops the checksum entries of an index file.
+func (r *DistroRelease) RemoveFile(path string) {
+	delete(r.MD5Sum, path)
+	delete(r.SHA1, path)
+	delete(r.SHA256, path)
+	delete(r.SHA512, path)
+}
+
+// ClearFiles drops every checksum entry, so that the Release can be rebuilt
+// from the index files that actually exist.
+func (r *DistroRelease) ClearFiles() {
+	r.MD5Sum = make(map[string]*PackageInfo)
+	r.SHA1 = make(map[string]*PackageInfo)
+	r.SHA256 = make(map[string]*PackageInfo)
+	r.SHA512 = make(map[string]*PackageInfo)
+}
+
+// UpdateComponents derives the Components and Architectures fields from the
+// binary-<arch> index directories listed in the checksum entries.
+func (r *DistroRelease) UpdateComponents() {
+	var components, architectures []string
+	for p := range r.SHA256 {
+		component, rest, found := strings.Cut(p, "/binary-")
+		if !found {
+			continue
+		}
+		arch, _, _ := strings.Cut(rest, "/")
+		if !slices.Contains(components, component) {
+			components = append(components, component)
+		}
+		if !slices.Contains(architectures, arch) {
+			architectures = append(architectures, arch)
+		}
+	}
+	slices.Sort(components)
+	slices.Sort(architectures)
+	r.Components = components
+	r.Architectures = architectures
+}
+
+// IsIndexFile reports whether a path relative to the distro directory names
+// an index file that belongs in the Release checksum lists.
+func IsIndexFile(p string) bool {
+	if !strings.Contains(p, "/") || strings.Contains(p, "/by-hash/") {
+		return false
+	}
+	name := path.Base(p)
+	return name == "Release" ||
+		name == "Packages" || strings.HasPrefix(name, "Packages.") ||
+		name == "Sources" || strings.HasPrefix(name, "Sources.") ||
+		strings.HasPrefix(name, "Contents-") ||
+		strings.HasPrefix(name, "Translation-")
+}
+
+// IsReleaseFile reports whether a path relative to the distro directory
+// names the Release file of the distro or one of its signatures.
+func IsReleaseFile(p string) bool {
+	return p == "Release" || p == "Release.gpg" || p == "InRelease"
+}
+
 func ParseReleaseFile(reader io.Reader) *DistroRelease {
 	release := &DistroRelease{
 		Origin:      "coScene APT source",
@@ -133,6 +222,10 @@ func ParseReleaseFile(reader io.Reader) *DistroRelease {
 			release.Codename = parts[1]
 		case "Date":
 			release.Date = parts[1]
+		case "Architectures":
+			release.Architectures = strings.Fields(parts[1])
+		case "Components":
+			release.Components = strings.Fields(parts[1])
 		case "Description":
 			release.Description = parts[1]
 		}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// remove deletes the Packages entries that match the package name, version,
+// architectures and filter of cfg from the indexes of the selected distros
+// and components, and re-signs the Release files of the distros it changed.
+// With cfg.DeleteDebs the package files of the removed entries are deleted
+// too, once no remaining index of any distro or snapshot references them,
+// directly or through a link, and the _latest_ aliases of deleted files are
+// pointed at the highest version left next to them or deleted.
+func remove(storageProvider storage.StorageProvider, cfg *config.Config, rep *report) error {
+	matches, err := packageMatcher(cfg)
+	if err != nil {
+		return err
+	}
+	targets := selectedDistros(cfg)
+
+	logging.Group("Scan repository")
+	objects, err := storageProvider.ListObjects(cfg.BucketName, "dists/")
+	if err != nil {
+		return fmt.Errorf("list repository failed: %v", err)
+	}
+
+	var updates []*distroUpdate
+	distroUpdates := make(map[string]*distroUpdate)
+	distroIndexes := make(map[string]map[string][]byte)
+	var remaining []*deb.DebFileInfo
+	var removedFiles []string
+	for _, obj := range objects {
+		distro, dir, ok := splitPackagesKey(obj.Key)
+		if !ok {
+			continue
+		}
+		// Suite aliases are mirrored from their codename when it is updated.
+		if _, ok := cfg.Repo.Suites[distro]; ok {
+			continue
+		}
+		content, err := storageProvider.GetObject(cfg.BucketName, obj.Key)
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", obj.Key, err)
+		}
+		packages := deb.ParsePackagesFile(bytes.NewReader(content))
+
+		component, _, _ := strings.Cut(dir, "/binary-")
+		if slices.Contains(targets, distro) && (cfg.Component == "" || component == cfg.Component) {
+			var removed []string
+			for name, pkg := range packages {
+				if matches(pkg) {
+					removed = append(removed, fmt.Sprintf("%s %s", name, pkg.Version))
+					removedFiles = append(removedFiles, pkg.Filename)
+					delete(packages, name)
+				}
+			}
+			if len(removed) > 0 {
+				slices.Sort(removed)
+				slog.Info("removing packages", "distro", distro, "index", dir, "packages", strings.Join(removed, ", "))
+
+				update, ok := distroUpdates[distro]
+				if !ok {
+					update = &distroUpdate{distro: distro}
+					distroUpdates[distro] = update
+					distroIndexes[distro] = make(map[string][]byte)
+					updates = append(updates, update)
+				}
+				objects, err := stagePackages(cfg, distro, dir, formatPackages(packages), distroIndexes[distro])
+				if err != nil {
+					return err
+				}
+				update.indexObjects = append(update.indexObjects, objects...)
+			}
+		}
+
+		for _, pkg := range packages {
+			remaining = append(remaining, pkg)
+		}
+	}
+
+	if len(updates) == 0 {
+		slog.Info("nothing to remove")
+		return nil
+	}
+
+	for _, update := range updates {
+		logging.Group("Ubuntu Distro: " + update.distro)
+		update.releaseObjects, err = stageRelease(storageProvider, cfg, update.distro, distroIndexes[update.distro], slog.With("distro", update.distro))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := publishUpdates(storageProvider, cfg, updates, rep); err != nil {
+		return err
+	}
+
+	if !cfg.DeleteDebs {
+		return nil
+	}
+
+	var referenced []string
+	for _, pkg := range remaining {
+		referenced = append(referenced, pkg.Filename)
+	}
+	// Files that snapshots list stay referenced, so that rolling back to a
+	// snapshot does not have to restore them.
+	snapshots, err := storageProvider.ListObjects(cfg.BucketName, "snapshots/")
+	if err != nil {
+		return fmt.Errorf("list snapshots failed: %v", err)
+	}
+	for _, obj := range snapshots {
+		if path.Base(obj.Key) != "Packages" || !strings.Contains(obj.Key, "/dists/") {
+			continue
+		}
+		packages, err := readPackagesIndex(storageProvider, cfg.BucketName, obj.Key)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range packages {
+			referenced = append(referenced, pkg.Filename)
+		}
+	}
+	// Promoted and all-distro entries are links to the files of other
+	// entries, which must be kept along with them.
+	keep, err := resolveLinks(storageProvider, cfg, referenced)
+	if err != nil {
+		return err
+	}
+
+	var obsolete []string
+	for _, file := range removedFiles {
+		if !keep[file] && !slices.Contains(obsolete, file) {
+			obsolete = append(obsolete, file)
+		}
+	}
+	aliases, err := updateLatestAliases(storageProvider, cfg, obsolete, remaining, keep)
+	if err != nil {
+		return err
+	}
+	obsolete = append(obsolete, aliases...)
+	slog.Info("deleting unreferenced packages", "count", len(obsolete))
+	if err := deleteObjects(storageProvider, cfg.BucketName, obsolete, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updateLatestAliases points the _latest_ alias next to each deleted package
+// file at the highest version of a remaining entry that shares the alias,
+// and returns the aliases no remaining entry shares, which are deleted with
+// the files. Aliases that link to a file that is kept are left alone.
+func updateLatestAliases(storageProvider storage.StorageProvider, cfg *config.Config, obsolete []string, remaining []*deb.DebFileInfo, keep map[string]bool) ([]string, error) {
+	var stale []string
+	done := make(map[string]bool)
+	for _, file := range obsolete {
+		alias, ok := latestAliasKey(file)
+		if !ok || done[alias] {
+			continue
+		}
+		done[alias] = true
+
+		// An alias stored as a copy has no target, so which version it
+		// holds is unknown and it is treated like a link to file.
+		target, err := storageProvider.GetSymlinkTarget(cfg.BucketName, alias)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read link %s failed: %v", alias, err)
+		}
+		if target != "" && !slices.Contains(obsolete, target) {
+			continue
+		}
+
+		var latest *deb.DebFileInfo
+		for _, pkg := range remaining {
+			if key, ok := latestAliasKey(pkg.Filename); !ok || key != alias || !keep[pkg.Filename] {
+				continue
+			}
+			if latest == nil || deb.CompareVersions(pkg.Version, latest.Version) > 0 {
+				latest = pkg
+			}
+		}
+		if latest == nil {
+			stale = append(stale, alias)
+			continue
+		}
+		slog.Info("creating redirect", "key", alias, "target", latest.Filename)
+		if err := storageProvider.CreateSymlink(cfg.BucketName, latest.Filename, alias); err != nil {
+			return nil, fmt.Errorf("create redirect %s failed: %v", alias, err)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/storage/storagetest"
+)
+
+func TestRemoveKeepsLinkedFiles(t *testing.T) {
+	const (
+		noble = "dists/noble/main/binary-amd64/"
+		jammy = "dists/jammy/main/binary-amd64/"
+	)
+	sp := storagetest.NewMemory()
+	foo := putPackage(sp, noble+"foo_1.0_amd64.deb", "foo", "1.0", []byte("foo 1.0"))
+	sp.CreateSymlink("", foo.Filename, noble+"foo_latest_amd64.deb")
+	sp.PutObject("", noble+"Packages", []byte(formatPackages(map[string]*deb.DebFileInfo{"foo": foo})))
+
+	// A promoted entry links to the file of its source.
+	promoted := *foo
+	promoted.Filename = jammy + "foo_1.0_amd64.deb"
+	sp.CreateSymlink("", foo.Filename, promoted.Filename)
+	sp.PutObject("", jammy+"Packages", []byte(formatPackages(map[string]*deb.DebFileInfo{"foo": &promoted})))
+
+	cfg := testConfig(t)
+	cfg.UbuntuDistro = "noble"
+	cfg.PackageName = "foo"
+	cfg.DeleteDebs = true
+	if err := remove(sp, cfg, newReport()); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	for _, key := range []string{foo.Filename, promoted.Filename, noble + "foo_latest_amd64.deb"} {
+		if content, err := sp.GetObject("", key); err != nil || string(content) != "foo 1.0" {
+			t.Errorf("%s is %q (%v) after remove, want foo 1.0", key, content, err)
+		}
+	}
+}
+
+func TestRemoveLatestAliases(t *testing.T) {
+	const dir = "pool/main/f/foo/"
+	sp := storagetest.NewMemory()
+	old := putPackage(sp, dir+"foo_0.9_amd64.deb", "foo", "0.9", []byte("foo 0.9"))
+	foo := putPackage(sp, dir+"foo_1.0_amd64.deb", "foo", "1.0", []byte("foo 1.0"))
+	bar := putPackage(sp, "pool/main/b/bar/bar_1.0_amd64.deb", "bar", "1.0", []byte("bar 1.0"))
+	sp.CreateSymlink("", foo.Filename, dir+"foo_latest_amd64.deb")
+	sp.CreateSymlink("", bar.Filename, "pool/main/b/bar/bar_latest_amd64.deb")
+	sp.PutObject("", "dists/noble/main/binary-amd64/Packages",
+		[]byte(formatPackages(map[string]*deb.DebFileInfo{"foo": foo, "bar": bar})))
+	sp.PutObject("", "dists/jammy/main/binary-amd64/Packages",
+		[]byte(formatPackages(map[string]*deb.DebFileInfo{"foo": old})))
+
+	cfg := testConfig(t)
+	cfg.UbuntuDistro = "noble"
+	cfg.Filter = "Package = foo | Package = bar"
+	cfg.DeleteDebs = true
+	if err := remove(sp, cfg, newReport()); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	if target, err := sp.GetSymlinkTarget("", dir+"foo_latest_amd64.deb"); err != nil || target != old.Filename {
+		t.Errorf("foo alias points at %q (%v), want %s", target, err, old.Filename)
+	}
+	for _, key := range []string{foo.Filename, bar.Filename, "pool/main/b/bar/bar_latest_amd64.deb"} {
+		if exists, _ := sp.HeadObject("", key); exists {
+			t.Errorf("%s was not deleted", key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// readLocalRepoFile reads the repository config file named by the
+// repo_config setting, or else apt-repo.yaml in the working directory if
+// there is one. It returns a nil file when there is neither.
+func readLocalRepoFile(settings *settings) (*config.RepoFile, string, error) {
+	path := settings.get("repo_config")
+	if path == "" {
+		if _, err := os.Stat(config.RepoFileName); err != nil {
+			return nil, "", nil
+		}
+		path = config.RepoFileName
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("read %s failed: %v", path, err)
+	}
+	file, err := config.ParseRepoFile(content)
+	if err != nil {
+		return nil, path, fmt.Errorf("%s is not valid: %v", path, err)
+	}
+	return file, path, nil
+}
+
+// readBucketRepoFile reads apt-repo.yaml at the root of the bucket. It
+// returns a nil file when the bucket has none.
+func readBucketRepoFile(storageProvider storage.StorageProvider, bucketName string) (*config.RepoFile, string, error) {
+	source := fmt.Sprintf("%s in bucket %s", config.RepoFileName, bucketName)
+	content, err := storageProvider.GetObject(bucketName, config.RepoFileName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, source, nil
+	}
+	if err != nil {
+		return nil, source, fmt.Errorf("get %s failed: %v", source, err)
+	}
+	file, err := config.ParseRepoFile(content)
+	if err != nil {
+		return nil, source, fmt.Errorf("%s is not valid: %v", source, err)
+	}
+	// The storage is already known by the time the file is read from it.
+	file.Storage = config.StorageConfig{}
+	return file, source, nil
+}
+
+// applyRepoFile applies a repository config file to cfg. The repository-wide
+// settings of the file are authoritative, so a run that sets one of them to
+// something else fails instead of publishing with different settings.
+func applyRepoFile(cfg *config.Config, file *config.RepoFile, source string, settings *settings) error {
+	for _, setting := range []struct {
+		name  string
+		agree bool
+	}{
+		{"distributions", len(file.Distributions) == 0 || slices.Equal(cfg.Repo.Distributions, file.Distributions)},
+		{"all_distributions", len(file.AllDistributions) == 0 || slices.Equal(cfg.Repo.AllDistributions, file.AllDistributions)},
+		{"suites", len(file.Suites) == 0 || maps.Equal(cfg.Repo.Suites, file.Suites)},
+		{"layout", file.Layout == "" || cfg.Layout == file.Layout},
+		{"symlink_strategy", file.SymlinkStrategy == "" || cfg.SymlinkStrategy == file.SymlinkStrategy},
+	} {
+		if settings.get(setting.name) != "" && !setting.agree {
+			return fmt.Errorf("%s is set to %q, which conflicts with %s", setting.name, settings.get(setting.name), source)
+		}
+	}
+
+	file.Apply(cfg, settings.get("min_age") != "")
+	slog.Info("using repository config", "source", source)
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/release"
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// snapshotRoot returns the repository root of a snapshot. A snapshot is a
+// repository of its own that apt can use directly:
+//
+//	deb https://<bucket-domain>/snapshots/<name> <distro> <component>
+func snapshotRoot(name string) string {
+	return fmt.Sprintf("snapshots/%s/", name)
+}
+
+// snapshot freezes the indexes and signed Release files of the selected
+// distros under snapshots/<name>/dists/. The package files they reference
+// are copied to the same path under the snapshot root, so that the snapshot
+// resolves every Filename by itself and rollback can restore them even once
+// they are deleted or overwritten. Snapshots are never overwritten.
+func snapshot(storageProvider storage.StorageProvider, cfg *config.Config) error {
+	root := snapshotRoot(cfg.SnapshotName)
+	distros := selectedDistros(cfg)
+
+	var indexObjects, releaseObjects []stagedObject
+	var files []string
+	copied := make(map[string]bool)
+	for _, distro := range distros {
+		prefix := fmt.Sprintf("dists/%s/", distro)
+		exists, err := storageProvider.HeadObject(cfg.BucketName, root+prefix+"Release")
+		if err != nil {
+			return fmt.Errorf("check snapshot %s failed: %v", cfg.SnapshotName, err)
+		}
+		if exists {
+			return fmt.Errorf("snapshot %s of %s already exists", cfg.SnapshotName, distro)
+		}
+
+		objects, err := storageProvider.ListObjects(cfg.BucketName, prefix)
+		if err != nil {
+			return fmt.Errorf("list %s failed: %v", prefix, err)
+		}
+		if !slices.ContainsFunc(objects, func(obj storage.ObjectInfo) bool { return obj.Key == prefix+"Release" }) {
+			if cfg.UbuntuDistro == config.AllDistros {
+				continue
+			}
+			return fmt.Errorf("%s is not published", distro)
+		}
+
+		logging.Group("Ubuntu Distro: " + distro)
+		for _, obj := range objects {
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			if !release.IsIndexFile(rel) && !release.IsReleaseFile(rel) {
+				continue
+			}
+			content, err := storageProvider.GetObject(cfg.BucketName, obj.Key)
+			if err != nil {
+				return fmt.Errorf("get %s failed: %v", obj.Key, err)
+			}
+			if release.IsReleaseFile(rel) {
+				releaseObjects = append(releaseObjects, stagedObject{root + obj.Key, content})
+				continue
+			}
+			indexObjects = append(indexObjects, stagedObject{root + obj.Key, content})
+
+			if path.Base(rel) != "Packages" {
+				continue
+			}
+			packages := deb.ParsePackagesFile(bytes.NewReader(content))
+			slog.Info("freezing index", "distro", distro, "index", path.Dir(rel), "packages", len(packages))
+			for _, pkg := range packages {
+				if !copied[pkg.Filename] {
+					copied[pkg.Filename] = true
+					files = append(files, pkg.Filename)
+				}
+			}
+		}
+	}
+
+	if len(indexObjects) == 0 && len(releaseObjects) == 0 {
+		return fmt.Errorf("nothing to snapshot")
+	}
+
+	logging.Group("Publish snapshot " + cfg.SnapshotName)
+	slog.Info("copying package files into snapshot", "count", len(files))
+	err := runParallel(cfg.Concurrency, len(files), func(i int, log *slog.Logger) error {
+		content, err := storageProvider.GetObject(cfg.BucketName, files[i])
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", files[i], err)
+		}
+		if err := storageProvider.PutObject(cfg.BucketName, root+files[i], content); err != nil {
+			return fmt.Errorf("copy %s failed: %v", files[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("publishing snapshot indexes", "count", len(indexObjects))
+	if err := putObjects(storageProvider, cfg.BucketName, indexObjects, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	// The Release files are copied as is, their signatures stay valid.
+	slog.Info("publishing snapshot Release files and signatures", "count", len(releaseObjects))
+	if err := putObjects(storageProvider, cfg.BucketName, releaseObjects, cfg.Concurrency); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rollback restores the selected distros to the indexes frozen in a
+// snapshot and re-signs their Release files with a current date. Package
+// files that have been deleted or overwritten since are restored from the
+// snapshot, and index files the distro gained since are deleted last.
+func rollback(storageProvider storage.StorageProvider, cfg *config.Config, rep *report) error {
+	root := snapshotRoot(cfg.SnapshotName)
+	distros := selectedDistros(cfg)
+
+	var updates []*distroUpdate
+	var files, obsolete []string
+	checksums := make(map[string]string)
+	for _, distro := range distros {
+		prefix := fmt.Sprintf("dists/%s/", distro)
+		releaseContent, err := storageProvider.GetObject(cfg.BucketName, root+prefix+"Release")
+		if errors.Is(err, storage.ErrNotFound) {
+			if cfg.UbuntuDistro == config.AllDistros {
+				continue
+			}
+			return fmt.Errorf("snapshot %s has no %s", cfg.SnapshotName, distro)
+		}
+		if err != nil {
+			return fmt.Errorf("get snapshot Release of %s failed: %v", distro, err)
+		}
+
+		logging.Group("Ubuntu Distro: " + distro)
+		frozen, err := storageProvider.ListObjects(cfg.BucketName, root+prefix)
+		if err != nil {
+			return fmt.Errorf("list snapshot of %s failed: %v", distro, err)
+		}
+		update := &distroUpdate{distro: distro}
+		indexes := make(map[string][]byte)
+		for _, obj := range frozen {
+			rel := strings.TrimPrefix(obj.Key, root+prefix)
+			if !release.IsIndexFile(rel) {
+				continue
+			}
+			content, err := storageProvider.GetObject(cfg.BucketName, obj.Key)
+			if err != nil {
+				return fmt.Errorf("get %s failed: %v", obj.Key, err)
+			}
+			indexes[rel] = content
+			update.indexObjects = append(update.indexObjects, stagedObject{prefix + rel, content})
+
+			if path.Base(rel) != "Packages" {
+				continue
+			}
+			packages := deb.ParsePackagesFile(bytes.NewReader(content))
+			slog.Info("restoring index", "distro", distro, "index", path.Dir(rel), "packages", len(packages))
+			for _, pkg := range packages {
+				if _, ok := checksums[pkg.Filename]; !ok {
+					checksums[pkg.Filename] = pkg.SHA256
+					files = append(files, pkg.Filename)
+				}
+			}
+		}
+
+		current, err := storageProvider.ListObjects(cfg.BucketName, prefix)
+		if err != nil {
+			return fmt.Errorf("list %s failed: %v", prefix, err)
+		}
+		for _, obj := range current {
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			if _, ok := indexes[rel]; release.IsIndexFile(rel) && !ok {
+				obsolete = append(obsolete, obj.Key)
+			}
+		}
+
+		releaseFile := release.ParseReleaseFile(bytes.NewReader(releaseContent))
+		releaseFile.Origin = cfg.Repo.Origin
+		releaseFile.Label = cfg.Repo.Label
+		releaseFile.Description = cfg.Repo.Description
+		releaseFile.Codename = distro
+		releaseFile.Suite = distro
+		if suite := cfg.Repo.SuiteFor(distro); suite != "" {
+			releaseFile.Suite = suite
+		}
+		releaseFile.ClearFiles()
+		for rel, content := range indexes {
+			releaseFile.SetFile(rel, content)
+		}
+		releaseFile.UpdateComponents()
+		releaseFile.Date = time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 -0700")
+		restoredRelease := releaseFile.ToString()
+
+		slog.Info("signing Release file", "distro", distro)
+		releaseGpg, inRelease, err := signReleaseFiles(restoredRelease, &cfg.GpgPrivateKey)
+		if err != nil {
+			return fmt.Errorf("sign files failed: %v", err)
+		}
+		update.releaseObjects = []stagedObject{
+			{prefix + "Release", []byte(restoredRelease)},
+			{prefix + "Release.gpg", releaseGpg},
+			{prefix + "InRelease", inRelease},
+		}
+		updates = append(updates, update)
+	}
+
+	if len(updates) == 0 {
+		return fmt.Errorf("snapshot %s does not exist", cfg.SnapshotName)
+	}
+
+	logging.Group("Check package files")
+	changed := make([]bool, len(files))
+	err := runParallel(cfg.Concurrency, len(files), func(i int, log *slog.Logger) error {
+		content, err := storageProvider.GetObject(cfg.BucketName, files[i])
+		if errors.Is(err, storage.ErrNotFound) {
+			changed[i] = true
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", files[i], err)
+		}
+		sum := sha256.Sum256(content)
+		changed[i] = hex.EncodeToString(sum[:]) != checksums[files[i]]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var restores []string
+	for i, file := range files {
+		if changed[i] {
+			restores = append(restores, file)
+		}
+	}
+
+	if len(restores) > 0 {
+		logging.Group("Restore package files")
+		err := runParallel(cfg.Concurrency, len(restores), func(i int, log *slog.Logger) error {
+			log.Info("restoring package file", "key", restores[i])
+			content, err := storageProvider.GetObject(cfg.BucketName, root+restores[i])
+			if err != nil {
+				return fmt.Errorf("get %s failed: %v", root+restores[i], err)
+			}
+			if err := storageProvider.PutObject(cfg.BucketName, restores[i], content); err != nil {
+				return fmt.Errorf("upload %s failed: %v", restores[i], err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := publishUpdates(storageProvider, cfg, updates, rep); err != nil {
+		return err
+	}
+
+	if len(obsolete) > 0 {
+		slog.Info("deleting indexes added since the snapshot", "count", len(obsolete))
+		if err := deleteObjects(storageProvider, cfg.BucketName, obsolete, cfg.Concurrency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/storage/storagetest"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testConfig returns the config of a run on jammy, with a fresh signing key.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	repo := config.DefaultRepoConfig()
+	repo.Distributions = []string{"jammy", "noble"}
+	return &config.Config{
+		Repo:          repo,
+		UbuntuDistro:  "jammy",
+		Concurrency:   2,
+		GpgPrivateKey: key.Bytes(),
+	}
+}
+
+// putPackage stores a package file and returns its Packages entry.
+func putPackage(sp *storagetest.Memory, key, name, version string, content []byte) *deb.DebFileInfo {
+	sp.PutObject("", key, content)
+	sum := sha256.Sum256(content)
+	return &deb.DebFileInfo{
+		Name:         name,
+		Version:      version,
+		Architecture: "amd64",
+		Filename:     key,
+		Size:         int64(len(content)),
+		SHA256:       hex.EncodeToString(sum[:]),
+	}
+}
+
+func TestRollbackRestoresPackageFiles(t *testing.T) {
+	const (
+		dir = "dists/jammy/main/binary-amd64/"
+		foo = dir + "foo_1.0_amd64.deb"
+		bar = dir + "bar_1.0_amd64.deb"
+	)
+	sp := storagetest.NewMemory()
+	packages := map[string]*deb.DebFileInfo{
+		"foo": putPackage(sp, foo, "foo", "1.0", []byte("foo 1.0")),
+		"bar": putPackage(sp, bar, "bar", "1.0", []byte("bar 1.0")),
+	}
+	sp.PutObject("", dir+"Packages", []byte(formatPackages(packages)))
+	sp.PutObject("", "dists/jammy/Release", []byte("Codename: jammy\n"))
+
+	cfg := testConfig(t)
+	cfg.SnapshotName = "before"
+	if err := snapshot(sp, cfg); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if target, _ := sp.GetSymlinkTarget("", "snapshots/before/"+foo); target != "" {
+		t.Errorf("snapshot links to %s instead of holding a copy", target)
+	}
+
+	sp.DeleteObject("", foo)
+	sp.PutObject("", bar, []byte("bar 1.0, rebuilt"))
+	if err := rollback(sp, cfg, newReport()); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	for key, want := range map[string]string{foo: "foo 1.0", bar: "bar 1.0"} {
+		if content, err := sp.GetObject("", key); err != nil || string(content) != want {
+			t.Errorf("%s is %q (%v) after rollback, want %q", key, content, err, want)
+		}
+	}
+}
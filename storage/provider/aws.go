@@ -2,15 +2,19 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
-	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type S3Provider struct {
-	Client *s3.S3
+	Client          *s3.S3
+	SymlinkStrategy string
 }
 
 func (p *S3Provider) PutObject(bucket, key string, content []byte) error {
@@ -20,7 +24,19 @@ func (p *S3Provider) PutObject(bucket, key string, content []byte) error {
 		Body:          bytes.NewReader(content),
 		ContentLength: aws.Int64(int64(len(content))),
 	})
-	return err
+	return mapS3Error(err)
+}
+
+func (p *S3Provider) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	req, _ := p.Client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(content),
+		ContentLength: aws.Int64(int64(len(content))),
+	})
+	// The SDK predates conditional writes, so the header is set by hand.
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	return mapS3Error(req.Send())
 }
 
 func (p *S3Provider) GetObject(bucket, key string) ([]byte, error) {
@@ -29,9 +45,14 @@ func (p *S3Provider) GetObject(bucket, key string) ([]byte, error) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, err
+		return nil, mapS3Error(err)
 	}
 	defer result.Body.Close()
+
+	// Follow zero-byte links written by the redirect and metadata strategies.
+	if target, ok := result.Metadata[symlinkTargetMeta]; ok && aws.Int64Value(result.ContentLength) == 0 {
+		return p.GetObject(bucket, aws.StringValue(target))
+	}
 	return io.ReadAll(result.Body)
 }
 
@@ -40,7 +61,7 @@ func (p *S3Provider) DeleteObject(bucket, key string) error {
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
-	return err
+	return mapS3Error(err)
 }
 
 func (p *S3Provider) HeadObject(bucket, key string) (bool, error) {
@@ -49,7 +70,8 @@ func (p *S3Provider) HeadObject(bucket, key string) (bool, error) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "404") {
+		err = mapS3Error(err)
+		if errors.Is(err, ErrNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -57,12 +79,103 @@ func (p *S3Provider) HeadObject(bucket, key string) (bool, error) {
 	return true, nil
 }
 
+func (p *S3Provider) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := p.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return objects, nil
+}
+
 func (p *S3Provider) CreateSymlink(bucket, target, symlink string) error {
-	// TODO(fei): better way to create symlink
-	_, err := p.Client.CopyObject(&s3.CopyObjectInput{
-		Bucket:     aws.String(bucket),
-		CopySource: aws.String(bucket + "/" + target),
-		Key:        aws.String(symlink),
+	switch p.SymlinkStrategy {
+	case SymlinkRedirect:
+		_, err := p.Client.PutObject(&s3.PutObjectInput{
+			Bucket:                  aws.String(bucket),
+			Key:                     aws.String(symlink),
+			Body:                    bytes.NewReader(nil),
+			ContentLength:           aws.Int64(0),
+			WebsiteRedirectLocation: aws.String("/" + target),
+			Metadata:                map[string]*string{symlinkTargetMeta: aws.String(target)},
+		})
+		return mapS3Error(err)
+	case SymlinkMetadata:
+		_, err := p.Client.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(bucket),
+			Key:           aws.String(symlink),
+			Body:          bytes.NewReader(nil),
+			ContentLength: aws.Int64(0),
+			Metadata:      map[string]*string{symlinkTargetMeta: aws.String(target)},
+		})
+		return mapS3Error(err)
+	default:
+		_, err := p.Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(bucket + "/" + target),
+			Key:        aws.String(symlink),
+		})
+		return mapS3Error(err)
+	}
+}
+
+func (p *S3Provider) GetSymlinkTarget(bucket, key string) (string, error) {
+	result, err := p.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		return "", mapS3Error(err)
+	}
+	// Copies made by the copy strategy are regular objects.
+	if target, ok := result.Metadata[symlinkTargetMeta]; ok && aws.Int64Value(result.ContentLength) == 0 {
+		return aws.StringValue(target), nil
+	}
+	return "", nil
+}
+
+// IsRetryable reports whether err is a throttling, server side or network
+// error, such as 503 SlowDown or a reset connection.
+func (p *S3Provider) IsRetryable(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch reqErr.StatusCode() {
+		case 429, 500, 502, 503, 504:
+			return true
+		}
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// mapS3Error wraps err with the matching storage sentinel error, keeping the
+// SDK error in the chain for retry classification.
+func mapS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if !errors.As(err, &reqErr) {
+		return err
+	}
+	switch {
+	case reqErr.StatusCode() == 404 || reqErr.Code() == s3.ErrCodeNoSuchKey || reqErr.Code() == "NotFound":
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case reqErr.StatusCode() == 412 || reqErr.Code() == "PreconditionFailed":
+		return fmt.Errorf("%w: %w", ErrPreconditionFailed, err)
+	case reqErr.StatusCode() == 403 || reqErr.Code() == "AccessDenied":
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	}
 	return err
 }
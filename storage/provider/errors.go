@@ -0,0 +1,9 @@
+package storage
+
+import "errors"
+
+var (
+	ErrNotFound           = errors.New("object not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrAccessDenied       = errors.New("access denied")
+)
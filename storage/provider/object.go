@@ -0,0 +1,10 @@
+package storage
+
+import "time"
+
+// ObjectInfo describes an object returned by a listing.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
@@ -2,8 +2,12 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"io"
+	"net"
+	"syscall"
 )
 
 type OSSProvider struct {
@@ -15,7 +19,15 @@ func (p *OSSProvider) PutObject(bucket, key string, content []byte) error {
 	if err != nil {
 		return err
 	}
-	return b.PutObject(key, bytes.NewReader(content))
+	return mapOSSError(b.PutObject(key, bytes.NewReader(content)))
+}
+
+func (p *OSSProvider) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	b, err := p.Client.Bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return mapOSSError(b.PutObject(key, bytes.NewReader(content), oss.ForbidOverWrite(true)))
 }
 
 func (p *OSSProvider) GetObject(bucket, key string) ([]byte, error) {
@@ -25,7 +37,7 @@ func (p *OSSProvider) GetObject(bucket, key string) ([]byte, error) {
 	}
 	obj, err := b.GetObject(key)
 	if err != nil {
-		return nil, err
+		return nil, mapOSSError(err)
 	}
 	defer obj.Close()
 	return io.ReadAll(obj)
@@ -36,7 +48,7 @@ func (p *OSSProvider) DeleteObject(bucket, key string) error {
 	if err != nil {
 		return err
 	}
-	return b.DeleteObject(key)
+	return mapOSSError(b.DeleteObject(key))
 }
 
 func (p *OSSProvider) HeadObject(bucket, key string) (bool, error) {
@@ -46,7 +58,8 @@ func (p *OSSProvider) HeadObject(bucket, key string) (bool, error) {
 	}
 	_, err = b.GetObjectMeta(key)
 	if err != nil {
-		if ossErr, ok := err.(oss.ServiceError); ok && ossErr.StatusCode == 404 {
+		err = mapOSSError(err)
+		if errors.Is(err, ErrNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -54,10 +67,92 @@ func (p *OSSProvider) HeadObject(bucket, key string) (bool, error) {
 	return true, nil
 }
 
+func (p *OSSProvider) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	b, err := p.Client.Bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	token := ""
+	for {
+		result, err := b.ListObjectsV2(oss.Prefix(prefix), oss.ContinuationToken(token))
+		if err != nil {
+			return nil, mapOSSError(err)
+		}
+		for _, obj := range result.Objects {
+			objects = append(objects, ObjectInfo{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
 func (p *OSSProvider) CreateSymlink(bucket, target, symlink string) error {
 	b, err := p.Client.Bucket(bucket)
 	if err != nil {
 		return err
 	}
-	return b.PutSymlink(symlink, target)
+	return mapOSSError(b.PutSymlink(symlink, target))
+}
+
+func (p *OSSProvider) GetSymlinkTarget(bucket, key string) (string, error) {
+	b, err := p.Client.Bucket(bucket)
+	if err != nil {
+		return "", err
+	}
+	meta, err := b.GetObjectDetailedMeta(key)
+	if err != nil {
+		return "", mapOSSError(err)
+	}
+	if meta.Get("X-Oss-Object-Type") != "Symlink" {
+		return "", nil
+	}
+	header, err := b.GetSymlink(key)
+	if err != nil {
+		return "", mapOSSError(err)
+	}
+	return header.Get(oss.HTTPHeaderOssSymlinkTarget), nil
+}
+
+// IsRetryable reports whether err is a throttling, server side or network
+// error, such as 503 ServiceUnavailable or a reset connection.
+func (p *OSSProvider) IsRetryable(err error) bool {
+	var serviceErr oss.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode == 429 || serviceErr.StatusCode >= 500 || serviceErr.Code == "RequestTimeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// mapOSSError wraps err with the matching storage sentinel error, keeping
+// the SDK error in the chain for retry classification.
+func mapOSSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var serviceErr oss.ServiceError
+	if !errors.As(err, &serviceErr) {
+		return err
+	}
+	switch {
+	case serviceErr.StatusCode == 404:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case serviceErr.StatusCode == 412 || serviceErr.Code == "FileAlreadyExists":
+		return fmt.Errorf("%w: %w", ErrPreconditionFailed, err)
+	case serviceErr.StatusCode == 403:
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	}
+	return err
 }
@@ -0,0 +1,24 @@
+package storage
+
+// Strategies for CreateSymlink. The default is SymlinkCopy on S3 and
+// SymlinkNative on OSS.
+const (
+	// SymlinkCopy stores a full server-side copy of the target.
+	SymlinkCopy = "copy"
+	// SymlinkRedirect stores a zero-byte object with
+	// x-amz-website-redirect-location pointing at the target, which the S3
+	// website endpoint answers with a 301.
+	SymlinkRedirect = "redirect"
+	// SymlinkMetadata stores a zero-byte object whose metadata names the
+	// target, for CDNs or proxies that resolve it.
+	SymlinkMetadata = "metadata"
+	// SymlinkNative uses the OSS symlink object type.
+	SymlinkNative = "symlink"
+	// SymlinkDedup creates no per-distro objects at all: Packages files
+	// point directly at the one shared .deb.
+	SymlinkDedup = "dedup"
+)
+
+// symlinkTargetMeta is the user metadata key naming the target of a
+// zero-byte link object.
+const symlinkTargetMeta = "Symlink-Target"
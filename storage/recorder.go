@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of changes a Recorder captures.
+const (
+	ChangePut    = "put"
+	ChangeDelete = "delete"
+	ChangeLink   = "link"
+)
+
+// Change is the last write a Recorder captured for a key. Target is the key
+// a link points at, and Size the size of the content put.
+type Change struct {
+	Kind   string
+	Key    string
+	Target string
+	Size   int64
+}
+
+// Recorder is a StorageProvider that never writes to the wrapped provider.
+// Puts, deletes and symlinks are captured in memory instead, and reads see
+// the captured changes on top of the wrapped provider, so that a command
+// run against a Recorder behaves as it would against the bucket and leaves
+// behind the list of changes it would have made.
+type Recorder struct {
+	provider StorageProvider
+
+	mu       sync.Mutex
+	changes  map[string]*Change
+	contents map[string][]byte
+	order    []string
+	now      time.Time
+}
+
+func NewRecorder(provider StorageProvider) *Recorder {
+	return &Recorder{
+		provider: provider,
+		changes:  make(map[string]*Change),
+		contents: make(map[string][]byte),
+		now:      time.Now(),
+	}
+}
+
+// Changes returns the captured changes in the order their keys were first
+// written.
+func (r *Recorder) Changes() []Change {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := make([]Change, 0, len(r.order))
+	for _, key := range r.order {
+		changes = append(changes, *r.changes[key])
+	}
+	return changes
+}
+
+// Content returns the content captured for key, and whether it was put.
+func (r *Recorder) Content(key string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	content, ok := r.contents[key]
+	return content, ok
+}
+
+func (r *Recorder) PutObject(bucket, key string, content []byte) error {
+	r.record(&Change{Kind: ChangePut, Key: key, Size: int64(len(content))}, content)
+	return nil
+}
+
+func (r *Recorder) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	exists, err := r.HeadObject(bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s exists", ErrPreconditionFailed, key)
+	}
+	return r.PutObject(bucket, key, content)
+}
+
+func (r *Recorder) GetObject(bucket, key string) ([]byte, error) {
+	change, content := r.lookup(key)
+	if change == nil {
+		return r.provider.GetObject(bucket, key)
+	}
+	switch change.Kind {
+	case ChangeDelete:
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	case ChangeLink:
+		return r.GetObject(bucket, change.Target)
+	}
+	return content, nil
+}
+
+func (r *Recorder) DeleteObject(bucket, key string) error {
+	r.record(&Change{Kind: ChangeDelete, Key: key}, nil)
+	return nil
+}
+
+func (r *Recorder) HeadObject(bucket, key string) (bool, error) {
+	change, _ := r.lookup(key)
+	if change == nil {
+		return r.provider.HeadObject(bucket, key)
+	}
+	return change.Kind != ChangeDelete, nil
+}
+
+// ListObjects lists the wrapped provider and applies the captured changes.
+// Objects written by the Recorder are listed as modified when it was
+// created; links are listed with a size of zero.
+func (r *Recorder) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	objects, err := r.provider.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	listed := make(map[string]bool)
+	result := objects[:0]
+	for _, obj := range objects {
+		listed[obj.Key] = true
+		if change, ok := r.changes[obj.Key]; ok {
+			if change.Kind == ChangeDelete {
+				continue
+			}
+			obj.Size, obj.LastModified = change.Size, r.now
+		}
+		result = append(result, obj)
+	}
+	for _, key := range r.order {
+		change := r.changes[key]
+		if listed[key] || change.Kind == ChangeDelete || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result = append(result, ObjectInfo{Key: key, Size: change.Size, LastModified: r.now})
+	}
+	slices.SortFunc(result, func(a, b ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return result, nil
+}
+
+func (r *Recorder) CreateSymlink(bucket, target, symlink string) error {
+	r.record(&Change{Kind: ChangeLink, Key: symlink, Target: target}, nil)
+	return nil
+}
+
+func (r *Recorder) GetSymlinkTarget(bucket, key string) (string, error) {
+	change, _ := r.lookup(key)
+	if change == nil {
+		return r.provider.GetSymlinkTarget(bucket, key)
+	}
+	switch change.Kind {
+	case ChangeDelete:
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+	case ChangeLink:
+		return change.Target, nil
+	}
+	return "", nil
+}
+
+func (r *Recorder) record(change *Change, content []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.changes[change.Key]; !ok {
+		r.order = append(r.order, change.Key)
+	}
+	r.changes[change.Key] = change
+	if change.Kind == ChangePut {
+		r.contents[change.Key] = content
+	} else {
+		delete(r.contents, change.Key)
+	}
+}
+
+func (r *Recorder) lookup(key string) (*Change, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.changes[key], r.contents[key]
+}
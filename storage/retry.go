@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const maxRetryBackoff = 30 * time.Second
+
+// RetryClassifier is implemented by providers that can tell transient
+// errors, such as throttling or a reset connection, apart from permanent
+// ones. Errors of providers that do not implement it are always retried.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryProvider is a StorageProvider that retries failed calls of the
+// wrapped provider with exponential backoff. Every operation it retries is
+// idempotent: puts and symlinks overwrite the whole object with the same
+// content, deleting an object that an earlier attempt already removed
+// succeeds, and a conditional put that an earlier attempt already stored
+// is recognised by its content.
+type RetryProvider struct {
+	provider StorageProvider
+	attempts int
+	backoff  time.Duration
+}
+
+func NewRetryProvider(provider StorageProvider, attempts int, backoff time.Duration) *RetryProvider {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	return &RetryProvider{
+		provider: provider,
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+func (p *RetryProvider) PutObject(bucket, key string, content []byte) error {
+	return p.retry("put", key, func() error {
+		return p.provider.PutObject(bucket, key, content)
+	})
+}
+
+func (p *RetryProvider) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	attempt := 0
+	return p.retry("put", key, func() error {
+		attempt++
+		err := p.provider.PutObjectIfNotExists(bucket, key, content)
+		if attempt > 1 && errors.Is(err, ErrPreconditionFailed) {
+			existing, getErr := p.provider.GetObject(bucket, key)
+			if getErr == nil && bytes.Equal(existing, content) {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+func (p *RetryProvider) GetObject(bucket, key string) ([]byte, error) {
+	var content []byte
+	err := p.retry("get", key, func() error {
+		var err error
+		content, err = p.provider.GetObject(bucket, key)
+		return err
+	})
+	return content, err
+}
+
+func (p *RetryProvider) DeleteObject(bucket, key string) error {
+	attempt := 0
+	return p.retry("delete", key, func() error {
+		attempt++
+		err := p.provider.DeleteObject(bucket, key)
+		if attempt > 1 && errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (p *RetryProvider) HeadObject(bucket, key string) (bool, error) {
+	var exists bool
+	err := p.retry("head", key, func() error {
+		var err error
+		exists, err = p.provider.HeadObject(bucket, key)
+		return err
+	})
+	return exists, err
+}
+
+func (p *RetryProvider) ListObjects(bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := p.retry("list", prefix, func() error {
+		var err error
+		objects, err = p.provider.ListObjects(bucket, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (p *RetryProvider) CreateSymlink(bucket, target, symlink string) error {
+	return p.retry("symlink", symlink, func() error {
+		return p.provider.CreateSymlink(bucket, target, symlink)
+	})
+}
+
+func (p *RetryProvider) GetSymlinkTarget(bucket, key string) (string, error) {
+	var target string
+	err := p.retry("read link", key, func() error {
+		var err error
+		target, err = p.provider.GetSymlinkTarget(bucket, key)
+		return err
+	})
+	return target, err
+}
+
+func (p *RetryProvider) retry(op, key string, call func() error) error {
+	backoff := p.backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= p.attempts || !p.isRetryable(err) {
+			return err
+		}
+
+		// Full jitter keeps parallel workers from retrying in lockstep.
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		slog.Warn("storage call failed, retrying", "operation", op, "key", key,
+			"attempt", fmt.Sprintf("%d/%d", attempt, p.attempts), "wait", wait.Round(time.Millisecond), "error", err)
+		time.Sleep(wait)
+
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+func (p *RetryProvider) isRetryable(err error) bool {
+	if classifier, ok := p.provider.(RetryClassifier); ok {
+		return classifier.IsRetryable(err)
+	}
+	return true
+}
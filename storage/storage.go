@@ -12,21 +12,48 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+type ObjectInfo = provider.ObjectInfo
+
+// Errors returned by every provider, wrapping the SDK error, so callers can
+// tell a missing object apart from a denied or failed request with errors.Is.
+var (
+	ErrNotFound           = provider.ErrNotFound
+	ErrPreconditionFailed = provider.ErrPreconditionFailed
+	ErrAccessDenied       = provider.ErrAccessDenied
+)
+
 type StorageProvider interface {
 	PutObject(bucket, key string, content []byte) error
+	// PutObjectIfNotExists fails with ErrPreconditionFailed if key exists.
+	PutObjectIfNotExists(bucket, key string, content []byte) error
 	GetObject(bucket, key string) ([]byte, error)
 	DeleteObject(bucket, key string) error
 	HeadObject(bucket, key string) (bool, error)
+	ListObjects(bucket, prefix string) ([]ObjectInfo, error)
 	CreateSymlink(bucket, target, symlink string) error
+	// GetSymlinkTarget returns the key a link created by CreateSymlink
+	// points at, or "" if key is a regular object.
+	GetSymlinkTarget(bucket, key string) (string, error)
 }
 
-func NewStorageProvider(providerType, endpoint, region, accessKey, secretKey string) (StorageProvider, error) {
+const (
+	SymlinkCopy     = provider.SymlinkCopy
+	SymlinkRedirect = provider.SymlinkRedirect
+	SymlinkMetadata = provider.SymlinkMetadata
+	SymlinkNative   = provider.SymlinkNative
+	SymlinkDedup    = provider.SymlinkDedup
+)
+
+func NewStorageProvider(providerType, endpoint, region, accessKey, secretKey, symlinkStrategy string) (StorageProvider, error) {
 	switch strings.ToLower(providerType) {
 	case "oss", "aliyun":
 		client, err := oss.New(endpoint, accessKey, secretKey)
 		if err != nil {
 			return nil, fmt.Errorf("initialize Aliyun OSS client failed: %v", err)
 		}
+		// Retries are left to RetryProvider, so that retry_attempts caps the
+		// attempts and a conditional put is never retried behind its back.
+		client.Config.RetryTimes = 0
 		return &provider.OSSProvider{Client: client}, nil
 
 	case "s3", "aws":
@@ -35,13 +62,15 @@ func NewStorageProvider(providerType, endpoint, region, accessKey, secretKey str
 			Endpoint:    aws.String(endpoint),
 			Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
 			DisableSSL:  aws.Bool(strings.HasPrefix(endpoint, "http://")),
+			// Retries are left to RetryProvider, as for OSS.
+			MaxRetries: aws.Int(0),
 			//S3ForcePathStyle: aws.Bool(false),
 			//S3UseAccelerate: aws.Bool(false),
 		})
 		if err != nil {
 			return nil, fmt.Errorf("initialize AWS S3 client failed: %v", err)
 		}
-		return &provider.S3Provider{Client: s3.New(sess)}, nil
+		return &provider.S3Provider{Client: s3.New(sess), SymlinkStrategy: symlinkStrategy}, nil
 
 	default:
 		return nil, fmt.Errorf("unsupported storage provider type: %s", providerType)
@@ -0,0 +1,139 @@
+// Package storagetest provides an in-memory storage provider for tests.
+package storagetest
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coscene-io/update-apt-source/storage"
+)
+
+// Memory is an in-memory storage provider whose links behave like OSS
+// symlinks: reads follow them. The bucket is ignored.
+type Memory struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	links    map[string]string
+	modified map[string]time.Time
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		objects:  make(map[string][]byte),
+		links:    make(map[string]string),
+		modified: make(map[string]time.Time),
+	}
+}
+
+func (m *Memory) PutObject(bucket, key string, content []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.links, key)
+	m.objects[key] = slices.Clone(content)
+	m.modified[key] = time.Now()
+	return nil
+}
+
+func (m *Memory) PutObjectIfNotExists(bucket, key string, content []byte) error {
+	if exists, _ := m.HeadObject(bucket, key); exists {
+		return storage.ErrPreconditionFailed
+	}
+	return m.PutObject(bucket, key, content)
+}
+
+func (m *Memory) GetObject(bucket, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if target, ok := m.links[key]; ok {
+		key = target
+	}
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return slices.Clone(content), nil
+}
+
+func (m *Memory) DeleteObject(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, isObject := m.objects[key]
+	_, isLink := m.links[key]
+	if !isObject && !isLink {
+		return storage.ErrNotFound
+	}
+	delete(m.objects, key)
+	delete(m.links, key)
+	delete(m.modified, key)
+	return nil
+}
+
+func (m *Memory) HeadObject(bucket, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, isObject := m.objects[key]
+	_, isLink := m.links[key]
+	return isObject || isLink, nil
+}
+
+func (m *Memory) ListObjects(bucket, prefix string) ([]storage.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []storage.ObjectInfo
+	for key, content := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.ObjectInfo{Key: key, Size: int64(len(content)), LastModified: m.modified[key]})
+		}
+	}
+	for key := range m.links {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.ObjectInfo{Key: key, LastModified: m.modified[key]})
+		}
+	}
+	slices.SortFunc(objects, func(a, b storage.ObjectInfo) int { return strings.Compare(a.Key, b.Key) })
+	return objects, nil
+}
+
+func (m *Memory) CreateSymlink(bucket, target, symlink string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, symlink)
+	m.links[symlink] = target
+	m.modified[symlink] = time.Now()
+	return nil
+}
+
+func (m *Memory) GetSymlinkTarget(bucket, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[key]; ok {
+		return "", nil
+	}
+	target, ok := m.links[key]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return target, nil
+}
+
+// Keys returns the key of every object and link, sorted.
+func (m *Memory) Keys() []string {
+	objects, _ := m.ListObjects("", "")
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = obj.Key
+	}
+	return keys
+}
+
+// Age makes every object and link look modified d ago.
+func (m *Memory) Age(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.modified {
+		m.modified[key] = time.Now().Add(-d)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/coscene-io/update-apt-source/config"
+	"github.com/coscene-io/update-apt-source/deb"
+	"github.com/coscene-io/update-apt-source/logging"
+	"github.com/coscene-io/update-apt-source/release"
+	"github.com/coscene-io/update-apt-source/storage"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// verify checks that the selected distros are consistent and correctly
+// signed: InRelease and Release.gpg must carry a valid signature by the
+// public key of cfg, every index listed in Release must exist with the
+// listed size and checksums, and every package file referenced from a
+// listed Packages index must exist with the listed size and SHA256. All
+// problems are logged as warnings, and an error is returned if there are
+// any.
+func verify(storageProvider storage.StorageProvider, cfg *config.Config) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(cfg.GpgPublicKey))
+	if err != nil {
+		return fmt.Errorf("read GPG public key failed: %v", err)
+	}
+
+	distros := selectedDistros(cfg)
+	if cfg.UbuntuDistro == config.AllDistros {
+		distros = append(slices.Clone(distros), slices.Sorted(maps.Keys(cfg.Repo.Suites))...)
+	}
+
+	v := &verifier{
+		storage:    storageProvider,
+		bucketName: cfg.BucketName,
+		keyring:    keyring,
+		files:      make(map[string]error),
+	}
+	problems, published := 0, 0
+	for _, distro := range distros {
+		logging.Group("Ubuntu Distro: " + distro)
+		log := slog.With("distro", distro)
+		found, err := v.verifyDistro(distro, cfg.Concurrency, log)
+		if err != nil {
+			return err
+		}
+		// With all, distros that were never published are skipped, but a
+		// distro asked for by name must exist.
+		if found == nil {
+			if cfg.UbuntuDistro != config.AllDistros {
+				log.Warn("distro not published")
+				problems++
+			}
+			continue
+		}
+		published++
+		for _, p := range found {
+			log.Warn(p)
+		}
+		if len(found) == 0 {
+			log.Info("distro verified")
+		}
+		problems += len(found)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	if published == 0 {
+		return fmt.Errorf("no distro is published")
+	}
+	slog.Info("repository verified")
+	return nil
+}
+
+type verifier struct {
+	storage    storage.StorageProvider
+	bucketName string
+	keyring    openpgp.EntityList
+
+	// files caches the result of checking a package file, which several
+	// distros may share.
+	files map[string]error
+	mu    sync.Mutex
+}
+
+// verifyDistro returns the problems found in one distro. It returns nil,
+// rather than an empty list, if the distro has no Release file at all.
+func (v *verifier) verifyDistro(distro string, concurrency int, log *slog.Logger) ([]string, error) {
+	prefix := fmt.Sprintf("dists/%s/", distro)
+	releaseContent, err := v.storage.GetObject(v.bucketName, prefix+"Release")
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %sRelease failed: %v", prefix, err)
+	}
+
+	problems := []string{}
+	if err := v.verifyReleaseGpg(prefix, releaseContent); err != nil {
+		problems = append(problems, fmt.Sprintf("Release.gpg: %v", err))
+	}
+	if err := v.verifyInRelease(prefix, releaseContent); err != nil {
+		problems = append(problems, fmt.Sprintf("InRelease: %v", err))
+	}
+
+	releaseFile := release.ParseReleaseFile(bytes.NewReader(releaseContent))
+	var packagesFiles []string
+	for _, p := range slices.Sorted(maps.Keys(releaseFile.SHA256)) {
+		content, err := v.storage.GetObject(v.bucketName, prefix+p)
+		if errors.Is(err, storage.ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("%s: listed in Release but missing", p))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s%s failed: %v", prefix, p, err)
+		}
+		if err := checkReleaseEntry(releaseFile, p, content); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		if path.Base(p) == "Packages" {
+			packagesFiles = append(packagesFiles, p)
+		}
+	}
+
+	for _, p := range packagesFiles {
+		content, err := v.storage.GetObject(v.bucketName, prefix+p)
+		if err != nil {
+			return nil, fmt.Errorf("get %s%s failed: %v", prefix, p, err)
+		}
+		packages := deb.ParsePackagesFile(bytes.NewReader(content))
+		names := slices.Sorted(maps.Keys(packages))
+		log.Info("checking packages", "index", path.Dir(p), "packages", len(names))
+
+		results := make([]error, len(names))
+		err = runParallel(concurrency, len(names), func(i int, _ *slog.Logger) error {
+			results[i] = v.checkPackageFile(packages[names[i]])
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, err := range results {
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: package %s: %v", path.Dir(p), names[i], err))
+			}
+		}
+	}
+	return problems, nil
+}
+
+func (v *verifier) verifyReleaseGpg(prefix string, releaseContent []byte) error {
+	signature, err := v.storage.GetObject(v.bucketName, prefix+"Release.gpg")
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("missing")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(releaseContent), bytes.NewReader(signature))
+	return err
+}
+
+func (v *verifier) verifyInRelease(prefix string, releaseContent []byte) error {
+	inRelease, err := v.storage.GetObject(v.bucketName, prefix+"InRelease")
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("missing")
+	}
+	if err != nil {
+		return err
+	}
+	block, _ := clearsign.Decode(inRelease)
+	if block == nil {
+		return fmt.Errorf("not a clearsigned message")
+	}
+	if _, err := openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return err
+	}
+	// Clearsigning drops the final line break of the signed text.
+	if !bytes.Equal(bytes.TrimRight(block.Plaintext, "\n"), bytes.TrimRight(releaseContent, "\n")) {
+		return fmt.Errorf("signed content differs from Release")
+	}
+	return nil
+}
+
+// checkReleaseEntry compares an index file with its size and checksums in
+// every hash section of the Release file.
+func checkReleaseEntry(releaseFile *release.DistroRelease, p string, content []byte) error {
+	expected := &release.DistroRelease{
+		MD5Sum: make(map[string]*release.PackageInfo),
+		SHA1:   make(map[string]*release.PackageInfo),
+		SHA256: make(map[string]*release.PackageInfo),
+		SHA512: make(map[string]*release.PackageInfo),
+	}
+	expected.SetFile(p, content)
+
+	sections := []struct {
+		name   string
+		listed map[string]*release.PackageInfo
+		actual map[string]*release.PackageInfo
+	}{
+		{"MD5Sum", releaseFile.MD5Sum, expected.MD5Sum},
+		{"SHA1", releaseFile.SHA1, expected.SHA1},
+		{"SHA256", releaseFile.SHA256, expected.SHA256},
+		{"SHA512", releaseFile.SHA512, expected.SHA512},
+	}
+	for _, s := range sections {
+		listed, ok := s.listed[p]
+		if !ok {
+			continue
+		}
+		actual := s.actual[p]
+		if listed.Size != actual.Size {
+			return fmt.Errorf("size is %d, Release lists %d", actual.Size, listed.Size)
+		}
+		if listed.Sum != actual.Sum {
+			return fmt.Errorf("%s is %s, Release lists %s", s.name, actual.Sum, listed.Sum)
+		}
+	}
+	return nil
+}
+
+// checkPackageFile compares the file of a package with the size and SHA256
+// of its Packages entry.
+func (v *verifier) checkPackageFile(pkg *deb.DebFileInfo) error {
+	v.mu.Lock()
+	err, ok := v.files[pkg.Filename+" "+pkg.SHA256]
+	v.mu.Unlock()
+	if ok {
+		return err
+	}
+
+	err = func() error {
+		content, err := v.storage.GetObject(v.bucketName, pkg.Filename)
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("%s is missing", pkg.Filename)
+		}
+		if err != nil {
+			return fmt.Errorf("get %s failed: %v", pkg.Filename, err)
+		}
+		if int64(len(content)) != pkg.Size {
+			return fmt.Errorf("%s is %d bytes, Packages lists %d", pkg.Filename, len(content), pkg.Size)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != pkg.SHA256 {
+			return fmt.Errorf("%s has SHA256 %s, Packages lists %s", pkg.Filename, hex.EncodeToString(sum[:]), pkg.SHA256)
+		}
+		return nil
+	}()
+
+	v.mu.Lock()
+	v.files[pkg.Filename+" "+pkg.SHA256] = err
+	v.mu.Unlock()
+	return err
+}